@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/daemon"
+	"GoGuard/internal/detect"
+	"GoGuard/internal/network"
+	"GoGuard/internal/vpn"
+	"go.uber.org/zap"
+)
+
+// Exit codes shared by every subcommand.
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNotConnected = 3
+)
+
+// ownerStopTimeout bounds the wait for another GoGuard process to tear its
+// tunnel down after `down` asked it to.
+const ownerStopTimeout = 30 * time.Second
+
+// errNotConnected is returned by commands that need a running tunnel.
+var errNotConnected = errors.New("not connected")
+
+// usageError marks an error caused by invalid command-line usage.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+// command is one `goguard <name>` subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands returns the command tree in the order shown by usage.
+func commands() []command {
+	return []command{
+		{"up", "Connect and keep the tunnel monitored (default)", runUp},
+		{"down", "Disconnect the tunnel and restore routes and DNS", runDown},
+		{"status", "Show whether the tunnel is up and traffic exits via Mullvad", runStatus},
+		{"switch", "Move the tunnel to another relay", runSwitch},
+		{"servers", "List, filter and probe relays", func(args []string) error { return runServers(args, os.Stdout) }},
+		{"exec", "Run a command outside the tunnel (exec --bypass -- cmd)", runExec},
+		{"keys", "Show the WireGuard public key registered for the interface", runKeys},
+		{"config", "Configuration tools (config validate)", runConfig},
+		{"daemon", "Run in the background, controlled over a Unix socket", runDaemon},
+		{"ctl", "Control a running daemon (status, connect, disconnect, switch, reload)", runCtl},
+	}
+}
+
+// dispatch runs the subcommand named by args[0] and returns the exit code.
+// Without a subcommand, or when the first argument is a flag, `up` is run so
+// existing invocations keep working.
+func dispatch(args []string) int {
+	name := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return exitCode(cmd.run(args))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+// exitCode maps a command error to the process exit code.
+func exitCode(err error) int {
+	var usage *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, errNotConnected):
+		fmt.Fprintln(os.Stderr, err)
+		return exitNotConnected
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+}
+
+// printUsage lists the available subcommands.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: goguard <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'goguard <command> -h' for the flags of a command.")
+}
+
+// parseFlags parses args into fs, turning parse failures into usage errors.
+// A help request is reported as flag.ErrHelp so callers can exit cleanly.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err: err}
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return &usageError{err: fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))}
+	}
+	return nil
+}
+
+// runDown disconnects the interface and restores routing and the DNS
+// configuration saved by `up`. After a crash the interface may already be
+// gone; the saved routing state is still restored. With -dry-run it only
+// prints the routing changes it would make.
+func runDown(args []string) error {
+	fs := flag.NewFlagSet("down", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "Show the routing changes without making them")
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := config.LoadSelectionConfig(*configFile, nil)
+	if err != nil {
+		return err
+	}
+
+	routing, err := vpn.SavedRouting()
+	if err != nil {
+		return err
+	}
+	up := vpn.InterfaceExists(cfg.InterfaceName)
+	if !up && routing == nil {
+		return fmt.Errorf("%w: interface %s is not up", errNotConnected, cfg.InterfaceName)
+	}
+
+	if owner, err := tunnelOwner(); err != nil {
+		return err
+	} else if owner != 0 && !*dryRun {
+		return stopOwner(cfg, owner)
+	}
+
+	if *dryRun {
+		var changes []network.RoutingChange
+		if routing != nil {
+			if changes, err = routing.Diff(); err != nil {
+				return err
+			}
+		}
+		printRoutingDiff(os.Stdout, cfg.InterfaceName, up, routing, changes)
+		return nil
+	}
+
+	originalDNS, err := network.LoadDNSBackup()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	cleanup(cfg, originalDNS, routing)
+	fmt.Printf("Disconnected %s\n", cfg.InterfaceName)
+	return nil
+}
+
+// printRoutingDiff prints what `down` would change to restore routing to
+// the saved state.
+func printRoutingDiff(w io.Writer, interfaceName string, up bool, routing *network.RoutingSnapshot, changes []network.RoutingChange) {
+	if up {
+		fmt.Fprintf(w, "Would take down %s\n", interfaceName)
+	}
+	if routing == nil {
+		fmt.Fprintln(w, "No saved routing state; only the tunnel's own routes and rules would be removed")
+		return
+	}
+
+	fmt.Fprintf(w, "Routing state saved %s by pid %d\n", routing.TakenAt.Format(time.RFC3339), routing.PID)
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "Routing already matches the saved state")
+		return
+	}
+	for _, change := range changes {
+		fmt.Fprintf(w, "  %s\n", change)
+	}
+}
+
+// tunnelOwner returns the PID of another running GoGuard process that owns
+// the tunnel, as recorded in the routing snapshot, or 0 when there is none.
+func tunnelOwner() (int, error) {
+	routing, err := vpn.SavedRouting()
+	if err != nil || routing == nil || !routing.OwnerRunning() {
+		return 0, err
+	}
+	return routing.PID, nil
+}
+
+// ownerDaemon returns a client for the daemon on the control socket when one
+// answers and has the tunnel up.
+func ownerDaemon(ctx context.Context, cfg *config.Config) (*daemon.Client, bool) {
+	client := daemon.NewClient(cfg.ControlSocket)
+	resp, err := client.Do(ctx, daemon.Request{Command: daemon.CommandStatus})
+	if err != nil || resp.Status == nil || !resp.Status.Connected {
+		return nil, false
+	}
+	return client, true
+}
+
+// stopOwner disconnects a tunnel owned by another GoGuard process, so that
+// its monitor does not bring the tunnel back. A daemon is asked to
+// disconnect; a `goguard up` process is sent SIGTERM, which makes it tear the
+// tunnel down and exit.
+func stopOwner(cfg *config.Config, owner int) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if client, ok := ownerDaemon(ctx, cfg); ok {
+		if _, err := client.Do(ctx, daemon.Request{Command: daemon.CommandDisconnect}); err != nil {
+			return err
+		}
+		fmt.Printf("Disconnected %s via the daemon\n", cfg.InterfaceName)
+		return nil
+	}
+
+	if err := syscall.Kill(owner, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to signal goguard process %d: %v", owner, err)
+	}
+	deadline := time.Now().Add(ownerStopTimeout)
+	for syscall.Kill(owner, 0) == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("goguard process %d did not exit within %s", owner, ownerStopTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	fmt.Printf("Disconnected %s by stopping goguard process %d\n", cfg.InterfaceName, owner)
+	return nil
+}
+
+// runStatus reports the interface state and the exit IP as seen by Mullvad.
+// It exits with exitNotConnected when traffic is not leaving through Mullvad.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := config.LoadSelectionConfig(*configFile, nil)
+	if err != nil {
+		return err
+	}
+
+	up := vpn.InterfaceExists(cfg.InterfaceName)
+	fmt.Printf("Interface:    %s (up: %t)\n", cfg.InterfaceName, up)
+	if up {
+		health := vpn.NewHealthChecker(cfg.InterfaceName, cfg.MaxHandshakeAge, cfg.StallTimeout)
+		health.ReadStats = vpn.NewBackend(cfg.Backend).Peers
+		report, err := health.Check()
+		if err != nil {
+			fmt.Printf("Handshake:    unknown (%v)\n", err)
+		} else {
+			fmt.Printf("Handshake:    %s ago (rx %d B, tx %d B)\n", report.HandshakeAge.Round(time.Second), report.RxBytes, report.TxBytes)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	status, err := vpn.NewStatusClient(cfg.StatusAPIURL, cfg.StatusAPITimeout).Check(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query connection status: %v", err)
+	}
+	fmt.Printf("Exit IP:      %s (%s, %s)\n", status.IP, status.City, status.CountryCode)
+	fmt.Printf("Mullvad exit: %t\n", status.MullvadExitIP)
+	if status.ServerHostname != "" {
+		fmt.Printf("Server:       %s (%s)\n", status.ServerHostname, status.ServerType)
+	}
+	fmt.Printf("Organization: %s\n", status.Organization)
+	fmt.Printf("Blacklisted:  %t\n", status.Blacklist.Blacklisted)
+
+	if !up || !status.MullvadExitIP {
+		return errNotConnected
+	}
+	return nil
+}
+
+// runSwitch selects a relay with the given overrides and moves the tunnel to it.
+func runSwitch(args []string) error {
+	fs := flag.NewFlagSet("switch", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	addSelectionFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := config.LoadConfig(*configFile, overridesFromFlags(fs))
+	if err != nil {
+		return err
+	}
+	if !vpn.InterfaceExists(cfg.InterfaceName) {
+		return fmt.Errorf("%w: interface %s is not up", errNotConnected, cfg.InterfaceName)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// A relay switched behind the owner's back would leave it monitoring,
+	// denylisting and firewalling the old relay.
+	owner, err := tunnelOwner()
+	if err != nil {
+		return err
+	}
+	if owner != 0 {
+		client, ok := ownerDaemon(ctx, cfg)
+		if !ok {
+			return fmt.Errorf("interface %s is owned by goguard process %d, which has no control socket; stop it or use 'goguard daemon' to switch relays", cfg.InterfaceName, owner)
+		}
+		resp, err := client.Do(ctx, daemon.Request{Command: daemon.CommandSwitch, Overrides: overridesFromFlags(fs)})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Switched to %s via the daemon in %s (%s)\n", resp.Switch.To, resp.Switch.Duration.Round(time.Millisecond), resp.Switch.Mode)
+		return nil
+	}
+
+	catalog := newRelayCatalog(cfg)
+	criteria, err := cfg.Criteria()
+	if err != nil {
+		return err
+	}
+
+	selectedServer, err := detect.SelectBestServer(ctx, catalog, criteria)
+	if err != nil {
+		return err
+	}
+
+	logger, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	vpnManager := vpn.NewVPNManager(cfg, logger, catalog)
+	result, err := vpnManager.SwitchServer(selectedServer)
+	if err != nil {
+		logger.Error("Failed to switch servers", zap.Error(err))
+		return err
+	}
+	fmt.Printf("Switched to %s (%s, %s) in %s (%s)\n", selectedServer.Hostname, selectedServer.CountryName, selectedServer.IPv4AddrIn,
+		result.Duration.Round(time.Millisecond), result.Mode)
+	return nil
+}
+
+// runKeys prints the public key of the interface's WireGuard private key.
+func runKeys(args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := config.LoadSelectionConfig(*configFile, nil)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := config.InterfacePublicKey(cfg.InterfaceName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Interface:  %s\n", cfg.InterfaceName)
+	fmt.Printf("Public key: %s\n", publicKey)
+	return nil
+}
+
+// runConfig implements `goguard config validate`.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: goguard config validate [-config path]")
+		return &usageError{err: fmt.Errorf("expected a config subcommand")}
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return ignoreHelp(err)
+	}
+
+	if _, err := config.LoadConfig(*configFile, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%s: configuration is valid\n", *configFile)
+	return nil
+}
+
+// ignoreHelp treats an explicit help request as success.
+func ignoreHelp(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"GoGuard/internal/network"
+)
+
+func TestPrintRoutingDiff(t *testing.T) {
+	takenAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	routing := &network.RoutingSnapshot{TakenAt: takenAt, PID: 4242, Interface: "wg0"}
+
+	tests := []struct {
+		name    string
+		up      bool
+		routing *network.RoutingSnapshot
+		changes []network.RoutingChange
+		want    string
+	}{
+		{
+			name: "no saved state",
+			up:   true,
+			want: "Would take down wg0\n" +
+				"No saved routing state; only the tunnel's own routes and rules would be removed\n",
+		},
+		{
+			name:    "already restored",
+			routing: routing,
+			want: "Routing state saved 2024-06-01T12:00:00Z by pid 4242\n" +
+				"Routing already matches the saved state\n",
+		},
+		{
+			name:    "changes",
+			up:      true,
+			routing: routing,
+			changes: []network.RoutingChange{
+				{Route: &network.RouteSpec{Dst: "0.0.0.0/0", Device: "wg0", Table: network.DefaultTunnelTable}},
+				{Rule: &network.RuleSpec{Priority: network.TunnelRulePriority, Table: network.DefaultTunnelTable, Mark: network.DefaultTunnelFwmark, Invert: true, SuppressPrefixlen: -1}},
+				{Add: true, Rule: &network.RuleSpec{Priority: network.BypassRulePriority, Table: 254, Dst: "192.168.1.0/24", SuppressPrefixlen: -1}},
+			},
+			want: "Would take down wg0\n" +
+				"Routing state saved 2024-06-01T12:00:00Z by pid 4242\n" +
+				"  - route 0.0.0.0/0 dev wg0\n" +
+				"  - rule 5300: not from all fwmark 0xca6c lookup 51820\n" +
+				"  + rule 5200: from all to 192.168.1.0/24 lookup 254\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			printRoutingDiff(&out, "wg0", tt.up, tt.routing, tt.changes)
+			if out.String() != tt.want {
+				t.Errorf("printRoutingDiff() output:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/daemon"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// newDaemon provides the daemon and ties its socket to the fx lifecycle.
+func newDaemon(lc fx.Lifecycle, logger *zap.Logger, cfg *config.Config, flags ConfigFlags) *daemon.Daemon {
+	d := daemon.New(flags.ConfigFile, cfg, logger)
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			if err := d.Listen(cfg.ControlSocket, cfg.ControlSocketGroup); err != nil {
+				return err
+			}
+			go func() {
+				if err := d.Serve(); err != nil {
+					logger.Error("Control socket failed", zap.Error(err))
+				}
+			}()
+			logger.Info("Daemon listening", zap.String("socket", cfg.ControlSocket))
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return d.Close(ctx)
+		},
+	})
+	return d
+}
+
+// runDaemon runs GoGuard as a long-lived daemon controlled over a Unix socket.
+// The tunnel is only brought up on request, or immediately with -connect.
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	connect := fs.Bool("connect", false, "Connect as soon as the daemon starts")
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	flags := ConfigFlags{ConfigFile: *configFile}
+	app := fx.New(
+		fx.Supply(flags),
+		fx.Provide(newLogger, loadConfig, newDaemon),
+		fx.Invoke(func(lc fx.Lifecycle, logger *zap.Logger, d *daemon.Daemon) {
+			if !*connect {
+				return
+			}
+			lc.Append(fx.Hook{
+				OnStart: func(ctx context.Context) error {
+					// Selection can outlast fx's start timeout, so connect in the background.
+					go func() {
+						if resp := d.Execute(daemon.Request{Command: daemon.CommandConnect}); !resp.OK {
+							logger.Error("Initial connect failed", zap.String("error", resp.Error))
+						}
+					}()
+					return nil
+				},
+			})
+		}),
+	)
+
+	app.Run()
+	return nil
+}
+
+// runCtl is the thin client for a running daemon:
+// goguard ctl <status|connect|disconnect|switch|reload> [flags].
+func runCtl(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: goguard ctl <status|connect|disconnect|switch|reload> [flags]")
+		return &usageError{err: fmt.Errorf("expected a ctl command")}
+	}
+	name, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("ctl "+name, flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	socket := fs.String("socket", "", "Control socket path (default from configuration)")
+	asJSON := fs.Bool("json", false, "Print the raw JSON response")
+	if name == daemon.CommandConnect || name == daemon.CommandSwitch {
+		addSelectionFlags(fs)
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	path := *socket
+	if path == "" {
+		cfg, err := config.LoadSelectionConfig(*configFile, nil)
+		if err != nil {
+			return err
+		}
+		path = cfg.ControlSocket
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	resp, err := daemon.NewClient(path).Do(ctx, daemon.Request{
+		Command:   name,
+		Overrides: overridesFromFlags(fs),
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(resp)
+	}
+
+	status := resp.Status
+	if status == nil || !status.Connected {
+		fmt.Println("Not connected")
+		if name == daemon.CommandStatus {
+			return errNotConnected
+		}
+		return nil
+	}
+	if sw := resp.Switch; sw != nil {
+		fmt.Printf("Switched from %s to %s in %s (%s)\n", sw.From, sw.To, sw.Duration.Round(time.Millisecond), sw.Mode)
+	}
+	fmt.Printf("Connected to %s (%s, %s) via %s since %s\n",
+		status.Server, status.City, status.CountryCode, status.Interface, status.ConnectedSince.Format(time.RFC3339))
+	return nil
+}
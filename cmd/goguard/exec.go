@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/network"
+)
+
+// runExec runs a command whose traffic bypasses the tunnel:
+// goguard exec --bypass -- cmd [args]. The process joins the configured
+// bypass cgroup and then replaces itself with the command, so the command
+// and everything it starts inherit the cgroup.
+func runExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	bypass := fs.Bool("bypass", false, "Route the command's traffic outside the tunnel")
+	var command []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, command = args[:i], args[i+1:]
+			break
+		}
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	if !*bypass || len(command) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: goguard exec --bypass -- <command> [args]")
+		return &usageError{err: fmt.Errorf("expected --bypass and a command")}
+	}
+
+	cfg, err := config.LoadSelectionConfig(*configFile, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.BypassExecCgroup == "" {
+		return fmt.Errorf("bypass_exec_cgroup is not configured")
+	}
+
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+	if err := network.JoinCgroup(cfg.BypassExecCgroup, os.Getpid()); err != nil {
+		return err
+	}
+	return syscall.Exec(path, command, os.Environ())
+}
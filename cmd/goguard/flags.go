@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"GoGuard/internal/config"
+)
+
+// flagKeys maps command-line flags to the configuration keys they override.
+var flagKeys = map[string]string{
+	"server":   "server_name",
+	"country":  "country_code",
+	"city":     "city",
+	"pattern":  "server_pattern",
+	"dns":      "dns",
+	"latency":  "use_latency_based_selection",
+	"owned":    "owned_only",
+	"provider": "providers",
+	"exclude":  "exclude_servers",
+}
+
+// listFlags are comma-separated flags that override list-valued keys.
+var listFlags = map[string]bool{
+	"dns":      true,
+	"provider": true,
+	"exclude":  true,
+}
+
+// addConfigFlag registers the -config flag shared by every command.
+func addConfigFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "config.yaml", "Path to configuration file")
+}
+
+// addSelectionFlags registers the server selection flags shared by the
+// commands that pick a relay.
+func addSelectionFlags(fs *flag.FlagSet) {
+	fs.String("server", "", "WireGuard server to connect to (e.g., se-mma-wg-001)")
+	fs.String("country", "", "Country for server selection (ISO alpha-2, alpha-3 or English name)")
+	fs.String("city", "", "City for server selection (e.g., se-got or Gothenburg)")
+	fs.String("pattern", "", "Hostname glob for server selection (e.g., de-fra-wg-*), or a regex prefixed with re:")
+}
+
+// overridesFromFlags collects the flags that were set explicitly on the
+// command line. Flags left at their default are omitted so they never
+// override the config file or environment.
+func overridesFromFlags(fs *flag.FlagSet) config.Overrides {
+	overrides := config.Overrides{}
+	fs.Visit(func(f *flag.Flag) {
+		key, ok := flagKeys[f.Name]
+		if !ok {
+			return
+		}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+
+		value := getter.Get()
+		if listFlags[f.Name] {
+			value = strings.Split(f.Value.String(), ",")
+		}
+		overrides[key] = value
+	})
+	return overrides
+}
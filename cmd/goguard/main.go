@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"GoGuard/internal/config"
@@ -23,123 +23,113 @@ func newLogger() (*zap.Logger, error) {
 	return zap.NewProduction()
 }
 
-// loadConfig loads the configuration from the specified file.
-func loadConfig(configFile string) (*config.Config, error) {
-	return config.LoadConfig(configFile)
+// ConfigFlags holds the command-line flags of `goguard up`.
+type ConfigFlags struct {
+	ConfigFile string
+	Overrides  config.Overrides
 }
 
-// ConfigFlags holds the command-line flags.
-type ConfigFlags struct {
-	ConfigFile   string
-	Server       string
-	Country      string
-	DNS          string
-	LatencyBased bool
+// loadConfig resolves the configuration once, with explicitly set flags
+// applied on top of the file and environment, before anything depends on it.
+func loadConfig(flags ConfigFlags) (*config.Config, error) {
+	return config.LoadConfig(flags.ConfigFile, flags.Overrides)
 }
 
-// provideConfigFlags parses and provides the command-line flags.
-func provideConfigFlags() ConfigFlags {
-	configFile := flag.String("config", "config.yaml", "Path to configuration file")
-	server := flag.String("server", "", "WireGuard server to connect to (e.g., se-mma-wg-001)")
-	country := flag.String("country", "", "Country code for server selection")
-	dns := flag.String("dns", "", "DNS server to use (comma-separated)")
-	latencyBased := flag.Bool("latency", true, "Use latency-based server selection")
-	flag.Parse()
+// parseConfigFlags parses the flags of `goguard up`.
+func parseConfigFlags(args []string) (ConfigFlags, error) {
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	addSelectionFlags(fs)
+	fs.String("dns", "", "DNS server to use (comma-separated)")
+	fs.Bool("latency", true, "Use latency-based server selection")
+	if err := parseFlags(fs, args); err != nil {
+		return ConfigFlags{}, err
+	}
 
 	return ConfigFlags{
-		ConfigFile:   *configFile,
-		Server:       *server,
-		Country:      *country,
-		DNS:          *dns,
-		LatencyBased: *latencyBased,
-	}
+		ConfigFile: *configFile,
+		Overrides:  overridesFromFlags(fs),
+	}, nil
+}
+
+// newRelayCatalog provides the relay catalog client shared by server selection and the VPN manager.
+func newRelayCatalog(cfg *config.Config) *detect.RelayCatalog {
+	return cfg.RelayCatalog()
 }
 
 // selectBestServer selects the best server based on the configuration.
-func selectBestServer(cfg *config.Config) (*detect.MullvadServer, error) {
-	return detect.SelectBestServer(cfg.ServerName, cfg.CountryCode, cfg.UseLatencyBasedSelection)
+// An interrupt during selection aborts the relay fetch and latency sweep.
+func selectBestServer(cfg *config.Config, catalog *detect.RelayCatalog) (*detect.MullvadServer, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	criteria, err := cfg.Criteria()
+	if err != nil {
+		return nil, err
+	}
+	return detect.SelectBestServer(ctx, catalog, criteria)
 }
 
-func run(lc fx.Lifecycle, logger *zap.Logger, cfg *config.Config, selectedServer *detect.MullvadServer, flags ConfigFlags) {
+// newVPNManager provides the VPN manager as an fx lifecycle component: it
+// connects to the selected server and starts monitoring on start, and stops
+// the monitor and tears the connection down exactly once on stop.
+func newVPNManager(lc fx.Lifecycle, logger *zap.Logger, cfg *config.Config, catalog *detect.RelayCatalog, selectedServer *detect.MullvadServer) *vpn.VPNManager {
+	vpnManager := vpn.NewVPNManager(cfg, logger, catalog)
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			if flags.Server != "" {
-				cfg.ServerName = flags.Server
-			}
-			if flags.Country != "" {
-				cfg.CountryCode = flags.Country
+			if err := vpnManager.Connect(selectedServer); err != nil {
+				return err
 			}
-			if flags.DNS != "" {
-				cfg.DNS = strings.Split(flags.DNS, ",")
-			}
-			cfg.UseLatencyBasedSelection = flags.LatencyBased
-
-			fmt.Printf("Selected server: %s (%s, %s)\n", selectedServer.Hostname, selectedServer.CountryName, selectedServer.IPv4AddrIn)
-			cfg.ServerName = selectedServer.Hostname
-			fmt.Printf("Configuration:\n%+v\n", cfg)
-
-			originalDNS, err := network.SaveOriginalDNSConfig()
-			if err != nil {
-				cleanup(cfg.InterfaceName, originalDNS)
-				return fmt.Errorf("failed to save original DNS config: %v", err)
-			}
-
-			err = vpn.SetupVPN(cfg, selectedServer)
-			if err != nil {
-				cleanup(cfg.InterfaceName, originalDNS)
-				return fmt.Errorf("failed to setup VPN: %v", err)
-			}
-
-			err = network.SetupRoutingAndDNS(cfg.InterfaceName, cfg.DNS)
-			if err != nil {
-				cleanup(cfg.InterfaceName, originalDNS)
-				return fmt.Errorf("failed to setup routing and DNS: %v", err)
+			if err := vpnManager.Start(ctx); err != nil {
+				return errors.Join(err, vpnManager.Stop(ctx))
 			}
-
-			vpnManager := vpn.NewVPNManager(cfg, logger)
-
-			// Start monitoring VPN connection
-			go vpnManager.MonitorConnection(originalDNS)
-			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-			go func() {
-				<-sigChan
-				logger.Info("Received termination signal. Cleaning up...")
-				cleanup(cfg.InterfaceName, originalDNS)
-				logger.Info("Cleanup complete. Exiting.")
-				os.Exit(0)
-			}()
-
 			return nil
 		},
+		OnStop: func(ctx context.Context) error {
+			logger.Info("Stopping. Cleaning up...")
+			return vpnManager.Stop(ctx)
+		},
 	})
+	return vpnManager
 }
 
-// cleanup reverts the DNS configuration and disconnects the VPN.
-func cleanup(interfaceName, originalDNS string) {
-	if err := vpn.DisconnectVPN(interfaceName); err != nil {
-		log.Printf("Failed to disconnect VPN: %v", err)
-	}
-	if err := network.RevertDefaultRoute(); err != nil {
-		log.Printf("Failed to revert default route: %v", err)
-	}
-	if err := network.RevertDNSConfig(originalDNS); err != nil {
-		log.Printf("Failed to revert DNS config: %v", err)
+func run(cfg *config.Config, selectedServer *detect.MullvadServer, vpnManager *vpn.VPNManager) {
+	fmt.Printf("Selected server: %s (%s, %s)\n", selectedServer.Hostname, selectedServer.CountryName, selectedServer.IPv4AddrIn)
+	fmt.Printf("Configuration:\n%+v\n", cfg)
+}
+
+// cleanup reverts the DNS configuration, disconnects the VPN with the
+// configured backend and restores routing to the saved snapshot, if any.
+func cleanup(cfg *config.Config, originalDNS string, routing *network.RoutingSnapshot) {
+	if err := vpn.Teardown(vpn.NewBackend(cfg.Backend), cfg.InterfaceName, originalDNS, routing); err != nil {
+		log.Printf("Cleanup failed: %v", err)
 	}
 }
 
-func main() {
+// runUp connects and blocks, monitoring the tunnel until interrupted. fx
+// handles SIGINT and SIGTERM and runs the OnStop teardown before returning.
+func runUp(args []string) error {
+	flags, err := parseConfigFlags(args)
+	if err != nil {
+		return ignoreHelp(err)
+	}
+
 	app := fx.New(
+		fx.Supply(flags),
 		fx.Provide(
 			newLogger,
-			provideConfigFlags,
-			func(flags ConfigFlags) string { return flags.ConfigFile },
 			loadConfig,
+			newRelayCatalog,
 			selectBestServer,
+			newVPNManager,
 		),
-		fx.Invoke(run),
+		// Recover runs first: selectBestServer is only constructed for run.
+		fx.Invoke(vpn.Recover, run),
 	)
 
 	app.Run()
+	return nil
+}
+
+func main() {
+	os.Exit(dispatch(os.Args[1:]))
 }
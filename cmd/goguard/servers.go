@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/detect"
+)
+
+// serverRow is one line of `goguard servers` output.
+type serverRow struct {
+	Hostname    string  `json:"hostname"`
+	CountryCode string  `json:"country_code"`
+	Country     string  `json:"country"`
+	City        string  `json:"city"`
+	IPv4        string  `json:"ipv4"`
+	Owned       bool    `json:"owned"`
+	Provider    string  `json:"provider"`
+	Probed      bool    `json:"probed"`
+	LatencyMS   float64 `json:"latency_ms,omitempty"`
+	JitterMS    float64 `json:"jitter_ms,omitempty"`
+	Loss        float64 `json:"loss,omitempty"`
+	ScoreMS     float64 `json:"score_ms,omitempty"`
+}
+
+// runServers implements `goguard servers`: it lists relays from the catalog
+// through the same filters the connector uses, optionally probing them.
+func runServers(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("servers", flag.ContinueOnError)
+	configFile := addConfigFlag(fs)
+	fs.String("country", "", "Country for server selection (ISO alpha-2, alpha-3 or English name)")
+	fs.String("city", "", "City for server selection (e.g., se-got or Gothenburg)")
+	fs.String("pattern", "", "Hostname glob for server selection (e.g., de-fra-wg-*), or a regex prefixed with re:")
+	fs.Bool("owned", false, "Only list Mullvad-owned relays")
+	fs.String("provider", "", "Only list relays from these providers (comma-separated)")
+	fs.String("exclude", "", "Hostnames to leave out (comma-separated)")
+	probe := fs.Bool("probe", false, "Probe each relay and report latency, jitter and loss")
+	sortBy := fs.String("sort", "", "Sort by hostname, country, city, latency, jitter or score (default score when probing, else hostname)")
+	limit := fs.Int("limit", 0, "Show at most this many relays (0 for all)")
+	asJSON := fs.Bool("json", false, "Print JSON instead of a table")
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := config.LoadSelectionConfig(*configFile, overridesFromFlags(fs))
+	if err != nil {
+		return err
+	}
+
+	criteria, err := cfg.Criteria()
+	if err != nil {
+		return err
+	}
+	pipeline, err := criteria.Pipeline(newRelayCatalog(cfg))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	servers, err := pipeline.Candidates(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]serverRow, len(servers))
+	for i, server := range servers {
+		rows[i] = serverRow{
+			Hostname:    server.Hostname,
+			CountryCode: server.CountryCode,
+			Country:     server.CountryName,
+			City:        server.CityName,
+			IPv4:        server.IPv4AddrIn,
+			Owned:       server.Owned,
+			Provider:    server.Provider,
+		}
+	}
+
+	if *probe {
+		// A sweep where no relay answered still lists every relay as unreachable.
+		results, err := detect.ProbeServers(ctx, servers, criteria.Probe)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		stats := make(map[string]detect.ServerLatency, len(results))
+		for _, result := range results {
+			stats[result.Server.Hostname] = result
+		}
+		for i := range rows {
+			result, ok := stats[rows[i].Hostname]
+			if !ok {
+				continue
+			}
+			rows[i].Probed = true
+			rows[i].LatencyMS = milliseconds(result.Median)
+			rows[i].JitterMS = milliseconds(result.Jitter)
+			rows[i].Loss = result.Loss
+			rows[i].ScoreMS = milliseconds(criteria.Score.Score(result))
+		}
+	}
+
+	key := *sortBy
+	if key == "" {
+		key = "hostname"
+		if *probe {
+			key = "score"
+		}
+	}
+	if err := sortServerRows(rows, key); err != nil {
+		return err
+	}
+	if *limit > 0 && *limit < len(rows) {
+		rows = rows[:*limit]
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+	return printServerTable(stdout, rows, *probe)
+}
+
+// sortServerRows orders rows by key. Unprobed relays always sort after probed
+// ones for the measurement keys.
+func sortServerRows(rows []serverRow, key string) error {
+	var less func(a, b serverRow) bool
+	measured := func(value func(serverRow) float64) func(a, b serverRow) bool {
+		return func(a, b serverRow) bool {
+			if a.Probed != b.Probed {
+				return a.Probed
+			}
+			return value(a) < value(b)
+		}
+	}
+
+	switch key {
+	case "hostname":
+		less = func(a, b serverRow) bool { return a.Hostname < b.Hostname }
+	case "country":
+		less = func(a, b serverRow) bool { return a.Country < b.Country }
+	case "city":
+		less = func(a, b serverRow) bool { return a.City < b.City }
+	case "latency":
+		less = measured(func(r serverRow) float64 { return r.LatencyMS })
+	case "jitter":
+		less = measured(func(r serverRow) float64 { return r.JitterMS })
+	case "score":
+		less = measured(func(r serverRow) float64 { return r.ScoreMS })
+	default:
+		return fmt.Errorf("unknown sort key %q (valid choices: hostname, country, city, latency, jitter, score)", key)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	return nil
+}
+
+// printServerTable writes rows as an aligned table.
+func printServerTable(w io.Writer, rows []serverRow, probed bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "HOSTNAME\tCOUNTRY\tCITY\tOWNED\tPROVIDER"
+	if probed {
+		header += "\tLATENCY\tJITTER\tLOSS\tSCORE"
+	}
+	fmt.Fprintln(tw, header)
+
+	for _, row := range rows {
+		line := fmt.Sprintf("%s\t%s\t%s\t%t\t%s", row.Hostname, row.CountryCode, row.City, row.Owned, row.Provider)
+		if probed {
+			if row.Probed {
+				line += fmt.Sprintf("\t%.1fms\t%.1fms\t%.0f%%\t%.1fms", row.LatencyMS, row.JitterMS, row.Loss*100, row.ScoreMS)
+			} else {
+				line += "\t-\t-\t100%\t-"
+			}
+		}
+		fmt.Fprintln(tw, line)
+	}
+	return tw.Flush()
+}
+
+// milliseconds converts d to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
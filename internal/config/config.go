@@ -3,56 +3,245 @@ package config
 import (
 	"GoGuard/internal/detect"
 	"GoGuard/internal/mullvad"
+	"GoGuard/internal/network"
+	"errors"
 	"fmt"
 	"github.com/spf13/viper"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
+// DefaultControlSocket is where the daemon listens for control requests.
+const DefaultControlSocket = "/run/goguard/goguard.sock"
+
 type Config struct {
-	MullvadAccountNumber     string   `mapstructure:"mullvad_account_number"`
-	InterfaceName            string   `mapstructure:"interface_name"`
-	ServerName               string   `mapstructure:"server_name"`
-	CountryCode              string   `mapstructure:"country_code"`
-	LocalNetworkCIDR         string   `mapstructure:"local_network_cidr"`
-	UseLatencyBasedSelection bool     `mapstructure:"use_latency_based_selection"`
-	DNS                      []string `mapstructure:"dns"`
-	PreUp                    []string `mapstructure:"pre_up"`
-	PostUp                   []string `mapstructure:"post_up"`
-	PreDown                  []string `mapstructure:"pre_down"`
-	PostDown                 []string `mapstructure:"post_down"`
-}
-
-func LoadConfig(configFile string) (*Config, error) {
+	MullvadAccountNumber     string        `mapstructure:"mullvad_account_number"`
+	InterfaceName            string        `mapstructure:"interface_name"`
+	ServerName               string        `mapstructure:"server_name"`
+	CountryCode              string        `mapstructure:"country_code"`
+	City                     string        `mapstructure:"city"`
+	ServerPattern            string        `mapstructure:"server_pattern"`
+	OwnedOnly                bool          `mapstructure:"owned_only"`
+	Providers                []string      `mapstructure:"providers"`
+	ExcludeServers           []string      `mapstructure:"exclude_servers"`
+	Ranking                  string        `mapstructure:"ranking"`
+	ProbeConcurrency         int           `mapstructure:"probe_concurrency"`
+	ProbeTimeout             time.Duration `mapstructure:"probe_timeout"`
+	ProbeDeadline            time.Duration `mapstructure:"probe_deadline"`
+	ProbeSamples             int           `mapstructure:"probe_samples"`
+	ProbeMethod              string        `mapstructure:"probe_method"`
+	ScoreJitterWeight        float64       `mapstructure:"score_jitter_weight"`
+	ScoreLossPenalty         time.Duration `mapstructure:"score_loss_penalty"`
+	LocalNetworkCIDRs        []string      `mapstructure:"local_network_cidr"`
+	IncludePrefixes          []string      `mapstructure:"include_prefixes"`
+	ExcludePrefixes          []string      `mapstructure:"exclude_prefixes"`
+	BypassCgroups            []string      `mapstructure:"bypass_cgroups"`
+	BypassExecCgroup         string        `mapstructure:"bypass_exec_cgroup"`
+	UseLatencyBasedSelection bool          `mapstructure:"use_latency_based_selection"`
+	DNS                      []string      `mapstructure:"dns"`
+	PreUp                    []string      `mapstructure:"pre_up"`
+	PostUp                   []string      `mapstructure:"post_up"`
+	PreDown                  []string      `mapstructure:"pre_down"`
+	PostDown                 []string      `mapstructure:"post_down"`
+	RelayAPIURL              string        `mapstructure:"relay_api_url"`
+	RelayAPITimeout          time.Duration `mapstructure:"relay_api_timeout"`
+	RelayCacheDir            string        `mapstructure:"relay_cache_dir"`
+	RelayCacheTTL            time.Duration `mapstructure:"relay_cache_ttl"`
+	StatusAPIURL             string        `mapstructure:"status_api_url"`
+	StatusAPITimeout         time.Duration `mapstructure:"status_api_timeout"`
+	HealthCheckInterval      time.Duration `mapstructure:"health_check_interval"`
+	StatusCheckInterval      time.Duration `mapstructure:"status_check_interval"`
+	FailureThreshold         int           `mapstructure:"failure_threshold"`
+	BackoffInitial           time.Duration `mapstructure:"backoff_initial"`
+	BackoffMax               time.Duration `mapstructure:"backoff_max"`
+	BackoffMultiplier        float64       `mapstructure:"backoff_multiplier"`
+	BackoffJitter            float64       `mapstructure:"backoff_jitter"`
+	MaxRetries               int           `mapstructure:"max_retries"`
+	FailoverPolicy           string        `mapstructure:"failover_policy"`
+	FailoverCandidates       int           `mapstructure:"failover_candidates"`
+	FailoverDenylistTTL      time.Duration `mapstructure:"failover_denylist_ttl"`
+	SwitchMode               string        `mapstructure:"switch_mode"`
+	SwitchHandshakeTimeout   time.Duration `mapstructure:"switch_handshake_timeout"`
+	Backend                  string        `mapstructure:"backend"`
+	KillSwitch               bool          `mapstructure:"kill_switch"`
+	MaxHandshakeAge          time.Duration `mapstructure:"max_handshake_age"`
+	StallTimeout             time.Duration `mapstructure:"stall_timeout"`
+	ControlSocket            string        `mapstructure:"control_socket"`
+	ControlSocketGroup       string        `mapstructure:"control_socket_group"`
+}
+
+// LoadConfig resolves the configuration needed to connect, including the
+// Mullvad account. See LoadSelectionConfig for the precedence rules.
+func LoadConfig(configFile string, overrides Overrides) (*Config, error) {
+	config, err := LoadSelectionConfig(configFile, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// LoadSelectionConfig resolves the configuration without requiring account
+// credentials, for commands that only query relays. Values are layered as
+// defaults < configFile < GOGUARD_* environment variables < overrides, and a
+// missing configFile is not an error.
+func LoadSelectionConfig(configFile string, overrides Overrides) (*Config, error) {
 	v := viper.New()
 	setDefaults(v)
-	v.AutomaticEnv()
 	v.SetEnvPrefix("GOGUARD")
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	if err := bindEnv(v); err != nil {
+		return nil, err
+	}
 
 	if configFile != "" {
-		if err := readConfigFile(v, configFile); err != nil {
+		if err := readConfigFile(v, configFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return nil, err
 		}
 	}
 
+	for key, value := range overrides {
+		v.Set(key, value)
+	}
+
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct: %w", err)
 	}
 
-	if err := validateConfig(&config); err != nil {
+	if err := validateSelection(&config); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
 
+// Criteria returns the server selection criteria described by the configuration.
+func (c *Config) Criteria() (detect.Criteria, error) {
+	prober, err := c.prober()
+	if err != nil {
+		return detect.Criteria{}, err
+	}
+
+	return detect.Criteria{
+		ServerName:  c.ServerName,
+		CountryCode: c.CountryCode,
+		City:        c.City,
+		Pattern:     c.ServerPattern,
+		OwnedOnly:   c.OwnedOnly,
+		Providers:   c.Providers,
+		Exclude:     c.ExcludeServers,
+		Ranking:     c.Ranking,
+		UseLatency:  c.UseLatencyBasedSelection,
+		Probe: detect.ProbeOptions{
+			Concurrency: c.ProbeConcurrency,
+			Timeout:     c.ProbeTimeout,
+			Deadline:    c.ProbeDeadline,
+			Samples:     c.ProbeSamples,
+			Prober:      prober,
+		},
+		Score: detect.ScoreWeights{
+			JitterWeight: c.ScoreJitterWeight,
+			LossPenalty:  c.ScoreLossPenalty,
+		},
+	}, nil
+}
+
+// AllowedIPs returns the destinations routed through the tunnel:
+// include_prefixes, or everything when empty, minus exclude_prefixes.
+func (c *Config) AllowedIPs() ([]netip.Prefix, error) {
+	return network.AllowedIPs(c.IncludePrefixes, c.ExcludePrefixes)
+}
+
+// SplitTunnel reports whether only part of the address space is routed
+// through the tunnel.
+func (c *Config) SplitTunnel() bool {
+	return len(c.IncludePrefixes) > 0 || len(c.ExcludePrefixes) > 0
+}
+
+// BypassPrefixes returns the destinations allowed outside the tunnel: the
+// local networks and, when split tunnelling, everything not in AllowedIPs.
+func (c *Config) BypassPrefixes() ([]string, error) {
+	bypass := append([]string(nil), c.LocalNetworkCIDRs...)
+	if !c.SplitTunnel() {
+		return bypass, nil
+	}
+
+	allowedIPs, err := c.AllowedIPs()
+	if err != nil {
+		return nil, err
+	}
+	outside, err := network.AllowedIPs(nil, network.FormatPrefixes(allowedIPs))
+	if err != nil {
+		return nil, err
+	}
+	return append(bypass, network.FormatPrefixes(outside)...), nil
+}
+
+// AppBypassCgroups returns the cgroups whose traffic bypasses the tunnel,
+// including the one used by `goguard exec --bypass`.
+func (c *Config) AppBypassCgroups() []string {
+	cgroups := append([]string(nil), c.BypassCgroups...)
+	if c.BypassExecCgroup != "" {
+		cgroups = append(cgroups, c.BypassExecCgroup)
+	}
+	return cgroups
+}
+
+// RelayCatalog returns the relay catalog client described by the configuration.
+func (c *Config) RelayCatalog() *detect.RelayCatalog {
+	catalog := detect.NewRelayCatalog(c.RelayAPIURL, &http.Client{Timeout: c.RelayAPITimeout})
+	if c.RelayCacheDir != "" {
+		catalog.Cache = detect.NewRelayCache(c.RelayCacheDir, c.RelayCacheTTL)
+	}
+	return catalog
+}
+
+// prober builds the configured latency prober. WireGuard probing needs the
+// private key already registered with Mullvad, so it is read from the
+// interface's existing WireGuard config rather than generated.
+func (c *Config) prober() (detect.Prober, error) {
+	var privateKey string
+	if c.ProbeMethod == "wireguard" {
+		configPath := GetWireGuardConfigPath(c.InterfaceName)
+		existingConfig, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("wireguard probing needs an existing key in %s: %v", configPath, err)
+		}
+		privateKey = extractKey(string(existingConfig), "PrivateKey")
+	}
+	return detect.NewProber(c.ProbeMethod, privateKey)
+}
+
 func setDefaults(v *viper.Viper) {
 	v.SetDefault("interface_name", "wg0")
 	v.SetDefault("dns", []string{"10.64.0.1"})
+	v.SetDefault("ranking", "latency")
+	v.SetDefault("probe_concurrency", detect.DefaultProbeConcurrency)
+	v.SetDefault("probe_timeout", detect.DefaultProbeTimeout)
+	v.SetDefault("probe_deadline", detect.DefaultProbeDeadline)
+	v.SetDefault("probe_samples", detect.DefaultProbeSamples)
+	v.SetDefault("probe_method", "tcp")
+	v.SetDefault("score_jitter_weight", detect.DefaultJitterWeight)
+	v.SetDefault("score_loss_penalty", detect.DefaultLossPenalty)
+	v.SetDefault("relay_api_url", detect.DefaultRelayAPIURL)
+	v.SetDefault("relay_api_timeout", detect.DefaultRelayAPITimeout)
+	v.SetDefault("relay_cache_dir", detect.DefaultRelayCacheDir)
+	v.SetDefault("relay_cache_ttl", detect.DefaultRelayCacheTTL)
+	v.SetDefault("failover_policy", detect.FailoverStay)
+	v.SetDefault("switch_mode", "peer")
+	v.SetDefault("backend", "netlink")
+	v.SetDefault("control_socket", DefaultControlSocket)
 }
 
 func readConfigFile(v *viper.Viper, configFile string) error {
@@ -67,6 +256,49 @@ func validateConfig(config *Config) error {
 	if config.MullvadAccountNumber == "" {
 		return fmt.Errorf("Mullvad account number is required")
 	}
+	allowedIPs, err := config.AllowedIPs()
+	if err != nil {
+		return err
+	}
+	if len(allowedIPs) == 0 {
+		return fmt.Errorf("include_prefixes minus exclude_prefixes leaves nothing to route through the tunnel")
+	}
+	for _, cidr := range config.LocalNetworkCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid local_network_cidr %q: %v", cidr, err)
+		}
+	}
+	return nil
+}
+
+func validateSelection(config *Config) error {
+	if _, err := detect.NewRanker(config.Ranking, detect.ProbeOptions{}, detect.ScoreWeights{}); err != nil {
+		return err
+	}
+	if config.BackoffJitter < 0 || config.BackoffJitter > 1 {
+		return fmt.Errorf("backoff_jitter must be between 0 and 1")
+	}
+	if config.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	if _, err := (detect.Criteria{}).FailoverScopes(nil, config.FailoverPolicy); err != nil {
+		return err
+	}
+	switch config.SwitchMode {
+	case "peer", "restart":
+	default:
+		return fmt.Errorf("unknown switch mode %q (valid choices: peer, restart)", config.SwitchMode)
+	}
+	switch config.Backend {
+	case "netlink", "wg-quick":
+	default:
+		return fmt.Errorf("unknown backend %q (valid choices: netlink, wg-quick)", config.Backend)
+	}
+	switch config.ProbeMethod {
+	case "tcp", "icmp", "wireguard":
+	default:
+		return fmt.Errorf("unknown probe method %q (valid choices: tcp, icmp, wireguard)", config.ProbeMethod)
+	}
 	return nil
 }
 
@@ -92,6 +324,21 @@ func getOrGenerateKeys(interfaceName string) (privateKey, publicKey string, err
 	return privateKey, publicKey, nil
 }
 
+// InterfacePublicKey returns the public key of the private key stored in the
+// interface's WireGuard config.
+func InterfacePublicKey(interfaceName string) (string, error) {
+	configPath := GetWireGuardConfigPath(interfaceName)
+	existingConfig, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read existing WireGuard config: %v", err)
+	}
+	privateKey := extractKey(string(existingConfig), "PrivateKey")
+	if privateKey == "" {
+		return "", fmt.Errorf("no private key in %s", configPath)
+	}
+	return generatePublicKey(privateKey)
+}
+
 func extractPrivateKey(configPath string) (string, error) {
 	existingConfig, err := ioutil.ReadFile(configPath)
 	if err != nil {
@@ -118,11 +365,16 @@ func GenerateWireGuardConfig(cfg *Config, server *detect.MullvadServer) (string,
 		return "", fmt.Errorf("failed to get client IP: %v", err)
 	}
 
-	config := buildWireGuardConfig(cfg, server, privateKey, clientIP)
+	allowedIPs, err := cfg.AllowedIPs()
+	if err != nil {
+		return "", err
+	}
+
+	config := buildWireGuardConfig(cfg, server, privateKey, clientIP, allowedIPs)
 	return ModifyWireGuardConfig(cfg, config), nil
 }
 
-func buildWireGuardConfig(cfg *Config, server *detect.MullvadServer, privateKey, clientIP string) string {
+func buildWireGuardConfig(cfg *Config, server *detect.MullvadServer, privateKey, clientIP string, allowedIPs []netip.Prefix) string {
 	return fmt.Sprintf(`[Interface]
 PrivateKey = %s
 Address = %s/32
@@ -130,9 +382,44 @@ DNS = %s
 
 [Peer]
 PublicKey = %s
-AllowedIPs = 0.0.0.0/0, ::/0
+AllowedIPs = %s
 Endpoint = %s:51820
-`, privateKey, clientIP, strings.Join(cfg.DNS, ", "), server.PublicKey, server.IPv4AddrIn)
+`, privateKey, clientIP, strings.Join(cfg.DNS, ", "), server.PublicKey, strings.Join(network.FormatPrefixes(allowedIPs), ", "), server.IPv4AddrIn)
+}
+
+// UpdateWireGuardPeer points the [Peer] section of the interface's WireGuard
+// config at server, so that a later wg-quick up uses the relay switched to
+// in place.
+func UpdateWireGuardPeer(interfaceName string, server *detect.MullvadServer) error {
+	configPath := GetWireGuardConfigPath(interfaceName)
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	inPeer := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inPeer = trimmed == "[Peer]"
+			continue
+		}
+		if !inPeer {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "PublicKey"):
+			lines[i] = "PublicKey = " + server.PublicKey
+		case strings.HasPrefix(trimmed, "Endpoint"):
+			lines[i] = fmt.Sprintf("Endpoint = %s:51820", server.IPv4AddrIn)
+		}
+	}
+
+	if err := os.WriteFile(configPath, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		return fmt.Errorf("failed to write WireGuard config: %v", err)
+	}
+	return nil
 }
 
 func extractKey(configContent, keyName string) string {
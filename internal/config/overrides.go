@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/spf13/viper"
+)
+
+// Overrides holds configuration values that take precedence over the config
+// file and environment, keyed by their config file name (e.g. "server_name").
+// Only values the user set explicitly belong here, so that an unset flag's
+// default never masks the file.
+type Overrides map[string]interface{}
+
+// Keys lists every configuration key, in Config field order.
+func Keys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("mapstructure"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// bindEnv binds every configuration key to its GOGUARD_* environment
+// variable. viper's AutomaticEnv only consults keys it already knows about,
+// which would silently ignore variables for keys without a default.
+func bindEnv(v *viper.Viper) error {
+	for _, key := range Keys() {
+		if err := v.BindEnv(key); err != nil {
+			return fmt.Errorf("failed to bind environment for %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultClientTimeout bounds a control request, which may include relay
+// selection and tunnel setup on the daemon side.
+const DefaultClientTimeout = 3 * time.Minute
+
+// Client talks to a running daemon over its control socket.
+type Client struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// NewClient creates a Client for the socket at path.
+func NewClient(path string) *Client {
+	if path == "" {
+		path = DefaultSocketPath
+	}
+	return &Client{SocketPath: path, Timeout: DefaultClientTimeout}
+}
+
+// Do sends req and waits for the response. A response reporting failure is
+// returned as an error.
+func (c *Client) Do(ctx context.Context, req Request) (*Response, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.SocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach daemon at %s: %w", c.SocketPath, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if !resp.OK {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
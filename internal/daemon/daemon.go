@@ -0,0 +1,318 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/detect"
+	"GoGuard/internal/vpn"
+	"go.uber.org/zap"
+)
+
+// selectionTimeout bounds relay selection triggered over the socket.
+const selectionTimeout = 2 * time.Minute
+
+// Daemon owns the VPN manager and serves the control socket API. Access is
+// controlled by the socket's file permissions: it is created mode 0660,
+// owned by the configured group, inside a 0750 directory.
+type Daemon struct {
+	ConfigFile string
+	Logger     *zap.Logger
+
+	mu       sync.Mutex
+	cfg      *config.Config
+	manager  *vpn.VPNManager
+	listener net.Listener
+	conns    sync.WaitGroup
+}
+
+// New creates a Daemon for the configuration resolved from configFile.
+func New(configFile string, cfg *config.Config, logger *zap.Logger) *Daemon {
+	return &Daemon{
+		ConfigFile: configFile,
+		Logger:     logger,
+		cfg:        cfg,
+	}
+}
+
+// Listen opens the control socket at path. A socket left behind by a
+// daemon that is no longer running is replaced; a live one is an error.
+func (d *Daemon) Listen(path, group string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create socket directory %s: %v", dir, err)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("another daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := restrictSocket(path, dir, group); err != nil {
+		listener.Close()
+		return err
+	}
+
+	d.mu.Lock()
+	d.listener = listener
+	d.mu.Unlock()
+	return nil
+}
+
+// restrictSocket limits the socket to its owner and group.
+func restrictSocket(path, dir, group string) error {
+	if group != "" {
+		grp, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("failed to look up socket group %s: %v", group, err)
+		}
+		gid, err := strconv.Atoi(grp.Gid)
+		if err != nil {
+			return fmt.Errorf("invalid gid for group %s: %v", group, err)
+		}
+		for _, p := range []string{dir, path} {
+			if err := os.Chown(p, -1, gid); err != nil {
+				return fmt.Errorf("failed to set group of %s: %v", p, err)
+			}
+		}
+	}
+	if err := os.Chmod(dir, 0750); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", dir, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %v", path, err)
+	}
+	return nil
+}
+
+// Serve accepts connections until the listener is closed by Close.
+func (d *Daemon) Serve() error {
+	d.mu.Lock()
+	listener := d.listener
+	d.mu.Unlock()
+	if listener == nil {
+		return fmt.Errorf("daemon is not listening")
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		d.conns.Add(1)
+		go func() {
+			defer d.conns.Done()
+			d.handle(conn)
+		}()
+	}
+}
+
+// Close stops accepting requests, waits for in-flight ones until ctx is done
+// and tears down the tunnel if one is up.
+func (d *Daemon) Close(ctx context.Context) error {
+	d.mu.Lock()
+	listener := d.listener
+	d.listener = nil
+	d.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.manager != nil {
+		err := d.manager.Stop(ctx)
+		d.manager = nil
+		return err
+	}
+	return nil
+}
+
+// handle serves the single request carried by conn.
+func (d *Daemon) handle(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		d.Logger.Warn("Failed to read control request", zap.Error(err))
+		return
+	}
+
+	var req Request
+	var resp Response
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp = Response{Error: fmt.Sprintf("invalid request: %v", err)}
+	} else {
+		resp = d.Execute(req)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		d.Logger.Warn("Failed to write control response", zap.Error(err))
+	}
+}
+
+// Execute runs one request. Requests are serialised so that a connect and a
+// disconnect can never interleave.
+func (d *Daemon) Execute(req Request) Response {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Logger.Info("Control request", zap.String("command", req.Command))
+
+	var err error
+	var switched *vpn.SwitchResult
+	switch req.Command {
+	case CommandStatus:
+	case CommandConnect:
+		err = d.connect(req.Overrides)
+	case CommandDisconnect:
+		err = d.disconnect()
+	case CommandSwitch:
+		switched, err = d.switchServer(req.Overrides)
+	case CommandReload:
+		err = d.reload()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		d.Logger.Error("Control request failed", zap.String("command", req.Command), zap.Error(err))
+		return Response{Error: err.Error()}
+	}
+	return Response{OK: true, Status: d.status(), Switch: switched}
+}
+
+// connect cleans up after a crashed session, selects a relay, brings the
+// tunnel up and starts monitoring it.
+func (d *Daemon) connect(overrides config.Overrides) error {
+	if d.manager != nil && d.manager.Connected() {
+		return fmt.Errorf("already connected to %s", d.manager.Server().Hostname)
+	}
+	if err := vpn.Recover(d.cfg, d.Logger); err != nil {
+		return err
+	}
+
+	cfg, server, err := d.selectServer(overrides)
+	if err != nil {
+		return err
+	}
+
+	manager := vpn.NewVPNManager(cfg, d.Logger, cfg.RelayCatalog())
+	if err := manager.Connect(server); err != nil {
+		return err
+	}
+	if err := manager.Start(context.Background()); err != nil {
+		return errors.Join(err, manager.Stop(context.Background()))
+	}
+	d.manager = manager
+	return nil
+}
+
+// disconnect stops monitoring and tears the tunnel down.
+func (d *Daemon) disconnect() error {
+	if d.manager == nil || !d.manager.Connected() {
+		return fmt.Errorf("not connected")
+	}
+	err := d.manager.Stop(context.Background())
+	d.manager = nil
+	return err
+}
+
+// switchServer moves the running tunnel to a newly selected relay.
+func (d *Daemon) switchServer(overrides config.Overrides) (*vpn.SwitchResult, error) {
+	if d.manager == nil || !d.manager.Connected() {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	_, server, err := d.selectServer(overrides)
+	if err != nil {
+		return nil, err
+	}
+	return d.manager.SwitchServer(server)
+}
+
+// reload re-resolves the configuration file. A running tunnel keeps its
+// settings until the next connect or switch.
+func (d *Daemon) reload() error {
+	cfg, err := config.LoadConfig(d.ConfigFile, nil)
+	if err != nil {
+		return err
+	}
+	d.cfg = cfg
+	return nil
+}
+
+// selectServer resolves the configuration with overrides and picks a relay.
+func (d *Daemon) selectServer(overrides config.Overrides) (*config.Config, *detect.MullvadServer, error) {
+	cfg := d.cfg
+	if len(overrides) > 0 {
+		var err error
+		cfg, err = config.LoadConfig(d.ConfigFile, overrides)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	criteria, err := cfg.Criteria()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selectionTimeout)
+	defer cancel()
+	server, err := detect.SelectBestServer(ctx, cfg.RelayCatalog(), criteria)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, server, nil
+}
+
+// status snapshots the tunnel state.
+func (d *Daemon) status() *Status {
+	status := &Status{Interface: d.cfg.InterfaceName}
+	if d.manager == nil || !d.manager.Connected() {
+		return status
+	}
+
+	server := d.manager.Server()
+	since := d.manager.ConnectedSince()
+	status.Connected = true
+	status.Interface = d.manager.Config.InterfaceName
+	status.Server = server.Hostname
+	status.CountryCode = server.CountryCode
+	status.City = server.CityName
+	status.Endpoint = server.IPv4AddrIn
+	status.ConnectedSince = &since
+	return status
+}
@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/vpn"
+)
+
+// DefaultSocketPath is where the daemon listens unless configured otherwise.
+const DefaultSocketPath = config.DefaultControlSocket
+
+// Commands understood by the control socket.
+const (
+	CommandStatus     = "status"
+	CommandConnect    = "connect"
+	CommandDisconnect = "disconnect"
+	CommandSwitch     = "switch"
+	CommandReload     = "reload"
+)
+
+// Request is a JSON message sent to the control socket, terminated by a
+// newline. Each connection carries exactly one request and one response.
+type Request struct {
+	Command string `json:"command"`
+	// Overrides apply on top of the daemon's configuration for connect and
+	// switch, using the same keys as the config file.
+	Overrides config.Overrides `json:"overrides,omitempty"`
+}
+
+// Response answers a Request. Status is set for every successful command,
+// and Switch for a successful switch.
+type Response struct {
+	OK     bool              `json:"ok"`
+	Error  string            `json:"error,omitempty"`
+	Status *Status           `json:"status,omitempty"`
+	Switch *vpn.SwitchResult `json:"switch,omitempty"`
+}
+
+// Status describes the tunnel owned by the daemon.
+type Status struct {
+	Connected      bool       `json:"connected"`
+	Interface      string     `json:"interface"`
+	Server         string     `json:"server,omitempty"`
+	CountryCode    string     `json:"country_code,omitempty"`
+	City           string     `json:"city,omitempty"`
+	Endpoint       string     `json:"endpoint,omitempty"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+}
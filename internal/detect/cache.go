@@ -0,0 +1,93 @@
+package detect
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultRelayCacheDir is where the relay list is cached between runs.
+	DefaultRelayCacheDir = "/var/cache/goguard"
+	// DefaultRelayCacheTTL is how long a cached relay list is used without revalidation.
+	DefaultRelayCacheTTL = time.Hour
+
+	relayCacheFile = "relays.json"
+)
+
+// RelayCache persists the last good relay list together with its validators.
+type RelayCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// cacheEntry is the on-disk representation of a cached relay list.
+type cacheEntry struct {
+	FetchedAt    time.Time       `json:"fetched_at"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Body         json.RawMessage `json:"body"`
+}
+
+// NewRelayCache creates a RelayCache rooted at dir.
+func NewRelayCache(dir string, ttl time.Duration) *RelayCache {
+	return &RelayCache{Dir: dir, TTL: ttl}
+}
+
+func (c *RelayCache) path() string {
+	return filepath.Join(c.Dir, relayCacheFile)
+}
+
+// load reads the cached entry. A missing cache is reported as (nil, nil).
+func (c *RelayCache) load() (*cacheEntry, error) {
+	data, err := os.ReadFile(c.path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay cache: %w", err)
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to decode relay cache: %w", err)
+	}
+	return &entry, nil
+}
+
+// store writes the entry atomically so a crash never leaves a truncated cache.
+func (c *RelayCache) store(entry *cacheEntry) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory %s: %w", c.Dir, err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode relay cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(c.Dir, relayCacheFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create relay cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write relay cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write relay cache: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write relay cache: %w", err)
+	}
+	return os.Rename(tmp.Name(), c.path())
+}
+
+// fresh reports whether the entry can be used without contacting the API.
+func (c *RelayCache) fresh(entry *cacheEntry, now time.Time) bool {
+	return entry != nil && now.Sub(entry.FetchedAt) < c.TTL
+}
@@ -0,0 +1,189 @@
+package detect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRelayAPIURL is the base URL of the Mullvad relay API.
+	DefaultRelayAPIURL = "https://api.mullvad.net"
+	// DefaultRelayAPITimeout bounds a single relay list request.
+	DefaultRelayAPITimeout = 15 * time.Second
+
+	relaysPath = "/www/relays/all/"
+)
+
+// ErrNoServers is returned when the relay list contains no WireGuard servers.
+var ErrNoServers = errors.New("no WireGuard servers found")
+
+// HTTPStatusError is returned when the relay API answers with a non-200 status.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("relay API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// DecodeError is returned when the relay list cannot be decoded.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode relay list: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// RelayCatalog fetches the Mullvad relay list from a configurable endpoint.
+type RelayCatalog struct {
+	BaseURL string
+	Client  *http.Client
+	// Cache is optional; when nil every call goes to the API.
+	Cache *RelayCache
+}
+
+// NewRelayCatalog creates a RelayCatalog. An empty baseURL selects the public
+// Mullvad API and a nil client selects a client with DefaultRelayAPITimeout.
+func NewRelayCatalog(baseURL string, client *http.Client) *RelayCatalog {
+	if baseURL == "" {
+		baseURL = DefaultRelayAPIURL
+	}
+	if client == nil {
+		client = &http.Client{Timeout: DefaultRelayAPITimeout}
+	}
+	return &RelayCatalog{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  client,
+	}
+}
+
+// FetchAll fetches every relay regardless of type. With a cache attached, a
+// fresh cached list is served directly, a stale one is revalidated with
+// If-None-Match/If-Modified-Since, and the last good list is used when the API
+// cannot be reached.
+func (c *RelayCatalog) FetchAll(ctx context.Context) ([]MullvadServer, error) {
+	if c.Cache == nil {
+		body, _, err := c.fetch(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRelays(body)
+	}
+
+	cached, err := c.Cache.load()
+	if err != nil {
+		// A corrupt cache is treated like an empty one.
+		cached = nil
+	}
+	if c.Cache.fresh(cached, time.Now()) {
+		if servers, err := decodeRelays(cached.Body); err == nil {
+			return servers, nil
+		}
+		cached = nil
+	}
+
+	body, entry, err := c.fetch(ctx, cached)
+	if err == nil {
+		var servers []MullvadServer
+		servers, err = decodeRelays(body)
+		if err == nil {
+			// Failing to persist the cache must not fail the fetch itself.
+			_ = c.Cache.store(entry)
+			return servers, nil
+		}
+	}
+
+	if cached != nil {
+		if servers, decodeErr := decodeRelays(cached.Body); decodeErr == nil {
+			return servers, nil
+		}
+	}
+	return nil, err
+}
+
+// fetch requests the relay list, revalidating against cached when it is set.
+// It returns the response body and the cache entry describing it.
+func (c *RelayCatalog) fetch(ctx context.Context, cached *cacheEntry) ([]byte, *cacheEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+relaysPath, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		entry := *cached
+		entry.FetchedAt = time.Now()
+		return cached.Body, &entry, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return body, &cacheEntry{
+		FetchedAt:    time.Now(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+	}, nil
+}
+
+// decodeRelays decodes a raw relay list.
+func decodeRelays(body []byte) ([]MullvadServer, error) {
+	var servers []MullvadServer
+	if err := json.Unmarshal(body, &servers); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	return servers, nil
+}
+
+// FetchWireGuard fetches the relay list and keeps only WireGuard servers.
+func (c *RelayCatalog) FetchWireGuard(ctx context.Context) ([]MullvadServer, error) {
+	servers, err := c.FetchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var wireguardServers []MullvadServer
+	for _, server := range servers {
+		if strings.ToLower(server.Type) == "wireguard" {
+			wireguardServers = append(wireguardServers, server)
+		}
+	}
+
+	if len(wireguardServers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	return wireguardServers, nil
+}
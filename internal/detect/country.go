@@ -0,0 +1,63 @@
+package detect
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/biter777/countries"
+)
+
+// ResolveCountryCode resolves an ISO 3166 alpha-2 or alpha-3 code or an English
+// country name to the lower-case alpha-2 code used by the relay API.
+func ResolveCountryCode(country string) (string, error) {
+	query := strings.TrimSpace(country)
+	if query == "" {
+		return "", fmt.Errorf("empty country")
+	}
+
+	code := countries.ByName(query)
+	if !code.IsValid() || len(code.Alpha2()) != 2 {
+		return "", fmt.Errorf("unknown country: %s", country)
+	}
+	return strings.ToLower(code.Alpha2()), nil
+}
+
+// matchCountry returns the relay country code that query refers to. The
+// relay's own code and name are tried first so Mullvad-specific spellings keep
+// working, then the query is resolved through ISO 3166.
+func matchCountry(servers []MullvadServer, query string) (string, error) {
+	query = strings.TrimSpace(query)
+	for _, server := range servers {
+		if strings.EqualFold(server.CountryCode, query) || strings.EqualFold(server.CountryName, query) {
+			return strings.ToLower(server.CountryCode), nil
+		}
+	}
+
+	code, err := ResolveCountryCode(query)
+	if err == nil {
+		for _, server := range servers {
+			if strings.EqualFold(server.CountryCode, code) {
+				return code, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no servers found in specified country: %s (valid choices: %s)", query, strings.Join(availableCountries(servers), ", "))
+}
+
+// availableCountries lists the countries present in servers as "code (name)".
+func availableCountries(servers []MullvadServer) []string {
+	seen := make(map[string]bool)
+	var choices []string
+	for _, server := range servers {
+		code := strings.ToLower(server.CountryCode)
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		choices = append(choices, fmt.Sprintf("%s (%s)", code, server.CountryName))
+	}
+	sort.Strings(choices)
+	return choices
+}
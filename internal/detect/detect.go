@@ -1,71 +1,74 @@
 package detect
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
-	"sort"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 )
 
-// MullvadServer represents a Mullvad VPN server.
+// MullvadServer represents a Mullvad VPN server as described by the relay API.
 type MullvadServer struct {
-	Hostname    string `json:"hostname"`
-	IPv4AddrIn  string `json:"ipv4_addr_in"`
-	CountryName string `json:"country_name"`
-	PublicKey   string `json:"pubkey"`
-	Type        string `json:"type"`
-	Latency     time.Duration
+	Hostname         string          `json:"hostname"`
+	FQDN             string          `json:"fqdn"`
+	Type             string          `json:"type"`
+	Active           bool            `json:"active"`
+	CountryCode      string          `json:"country_code"`
+	CountryName      string          `json:"country_name"`
+	CityCode         string          `json:"city_code"`
+	CityName         string          `json:"city_name"`
+	IPv4AddrIn       string          `json:"ipv4_addr_in"`
+	IPv6AddrIn       string          `json:"ipv6_addr_in"`
+	PublicKey        string          `json:"pubkey"`
+	Owned            bool            `json:"owned"`
+	Provider         string          `json:"provider"`
+	NetworkPortSpeed int             `json:"network_port_speed"`
+	STBoot           bool            `json:"stboot"`
+	MultihopPort     int             `json:"multihop_port"`
+	SocksName        string          `json:"socks_name"`
+	SocksPort        int             `json:"socks_port"`
+	DAITA            bool            `json:"daita"`
+	StatusMessages   []StatusMessage `json:"status_messages"`
+	Latency          time.Duration
 }
 
-// FetchAllMullvadServers fetches the list of all Mullvad servers.
-func FetchAllMullvadServers() ([]MullvadServer, error) {
-	url := "https://api.mullvad.net/www/relays/all/"
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	var servers []MullvadServer
-	err = json.Unmarshal(body, &servers)
-	if err != nil {
-		return nil, fmt.Errorf("JSON unmarshaling failed: %v", err)
-	}
-
-	var wireguardServers []MullvadServer
-	for _, server := range servers {
-		if strings.ToLower(server.Type) == "wireguard" {
-			wireguardServers = append(wireguardServers, server)
-		}
-	}
-
-	if len(wireguardServers) == 0 {
-		return nil, fmt.Errorf("no WireGuard servers found")
-	}
+// StatusMessage is an operator notice attached to a relay.
+type StatusMessage struct {
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+}
 
-	return wireguardServers, nil
+// FetchAllMullvadServers fetches the list of all Mullvad WireGuard servers from the catalog.
+func FetchAllMullvadServers(ctx context.Context, catalog Catalog) ([]MullvadServer, error) {
+	return catalog.FetchWireGuard(ctx)
 }
 
-// ServerLatency holds the latency information of a server.
+// ServerLatency holds the latency statistics of a server over several samples.
 type ServerLatency struct {
-	Server  MullvadServer
+	Server MullvadServer
+	// Latency is the median round trip, kept for callers that want one number.
 	Latency time.Duration
+	Min     time.Duration
+	Median  time.Duration
+	P95     time.Duration
+	// Jitter is the mean absolute difference between consecutive round trips.
+	Jitter time.Duration
+	// Loss is the fraction of probes that got no answer, from 0 to 1.
+	Loss float64
 }
 
 // TCPPing pings a server to measure latency.
 func TCPPing(ip string, port int) (time.Duration, error) {
+	return TCPPingContext(context.Background(), ip, port, DefaultProbeTimeout)
+}
+
+// TCPPingContext measures the time to complete a TCP handshake with ip:port,
+// giving up after timeout or when ctx is done.
+func TCPPingContext(ctx context.Context, ip string, port int, timeout time.Duration) (time.Duration, error) {
+	dialer := net.Dialer{Timeout: timeout}
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip, port), 500*time.Millisecond)
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
 	if err != nil {
 		return 0, err
 	}
@@ -74,166 +77,48 @@ func TCPPing(ip string, port int) (time.Duration, error) {
 }
 
 // FindBestServers finds the best Mullvad servers based on latency.
-func FindBestServers(count int) ([]MullvadServer, error) {
-	servers, err := FetchAllMullvadServers()
-	if err != nil {
-		return nil, err
-	}
-
-	results := make(chan ServerLatency, len(servers))
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 50)
-
-	for _, server := range servers {
-		wg.Add(1)
-		go func(server MullvadServer) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			latency, err := TCPPing(server.IPv4AddrIn, 443)
-			if err != nil {
-				return
-			}
-
-			results <- ServerLatency{Server: server, Latency: latency}
-		}(server)
-	}
-
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	var serverLatencies []ServerLatency
-	for result := range results {
-		serverLatencies = append(serverLatencies, result)
-	}
-
-	if len(serverLatencies) == 0 {
-		return nil, fmt.Errorf("no servers were successfully pinged")
-	}
-
-	sort.Slice(serverLatencies, func(i, j int) bool {
-		return serverLatencies[i].Latency < serverLatencies[j].Latency
-	})
-
-	if count > len(serverLatencies) {
-		count = len(serverLatencies)
-	}
-
-	var bestServers []MullvadServer
-	for i := 0; i < count; i++ {
-		bestServers = append(bestServers, serverLatencies[i].Server)
-	}
-
-	return bestServers, nil
+func FindBestServers(ctx context.Context, catalog Catalog, count int) ([]MullvadServer, error) {
+	pipeline := &Pipeline{Catalog: catalog, Ranker: LatencyRanker{Score: DefaultScoreWeights()}}
+	return pipeline.Select(ctx, count)
 }
 
 // FindBestServersInCountry finds the best Mullvad servers in a specific country based on latency.
-func FindBestServersInCountry(countryCode string, count int) ([]MullvadServer, error) {
-	servers, err := FetchAllMullvadServers()
-	if err != nil {
-		return nil, err
-	}
-
-	var countryServers []MullvadServer
-	for _, server := range servers {
-		if strings.EqualFold(server.CountryName, countryCode) {
-			countryServers = append(countryServers, server)
-		}
-	}
-
-	if len(countryServers) == 0 {
-		return nil, fmt.Errorf("no servers found in specified country: %s", countryCode)
-	}
-
-	results := make(chan ServerLatency, len(countryServers))
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 50)
-
-	for _, server := range countryServers {
-		wg.Add(1)
-		go func(server MullvadServer) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			latency, err := TCPPing(server.IPv4AddrIn, 443)
-			if err != nil {
-				return
-			}
-
-			results <- ServerLatency{Server: server, Latency: latency}
-		}(server)
-	}
-
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	var serverLatencies []ServerLatency
-	for result := range results {
-		serverLatencies = append(serverLatencies, result)
-	}
-
-	if len(serverLatencies) == 0 {
-		return nil, fmt.Errorf("no servers were successfully pinged")
-	}
-
-	sort.Slice(serverLatencies, func(i, j int) bool {
-		return serverLatencies[i].Latency < serverLatencies[j].Latency
-	})
-
-	if count > len(serverLatencies) {
-		count = len(serverLatencies)
-	}
-
-	var bestServers []MullvadServer
-	for i := 0; i < count; i++ {
-		bestServers = append(bestServers, serverLatencies[i].Server)
-	}
-
-	return bestServers, nil
+// The country may be given as an ISO alpha-2 or alpha-3 code or as an English name.
+func FindBestServersInCountry(ctx context.Context, catalog Catalog, countryCode string, count int) ([]MullvadServer, error) {
+	pipeline := &Pipeline{Catalog: catalog, Filters: []ServerFilter{CountryFilter(countryCode)}, Ranker: LatencyRanker{Score: DefaultScoreWeights()}}
+	return pipeline.Select(ctx, count)
 }
 
-// SelectBestServer selects the best Mullvad server based on the given configuration.
-func SelectBestServer(serverName, countryCode string, useLatencyBasedSelection bool) (*MullvadServer, error) {
-	var bestServers []MullvadServer
-	var err error
-
-	switch {
-	case serverName != "":
-		bestServers, err = FetchAllMullvadServers()
+// SelectBestServer selects the best Mullvad server based on the given criteria.
+func SelectBestServer(ctx context.Context, catalog Catalog, criteria Criteria) (*MullvadServer, error) {
+	if criteria.ServerName != "" {
+		servers, err := catalog.FetchWireGuard(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch Mullvad servers: %v", err)
 		}
-		for _, server := range bestServers {
-			if server.Hostname == serverName {
+		for _, server := range servers {
+			if server.Hostname == criteria.ServerName {
 				return &server, nil
 			}
 		}
-		return nil, fmt.Errorf("specified server %s not found", serverName)
+		return nil, fmt.Errorf("specified server %s not found", criteria.ServerName)
+	}
 
-	case countryCode != "":
-		bestServers, err = FindBestServersInCountry(countryCode, 1)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find best server in country: %v", err)
-		}
-		if len(bestServers) > 0 {
-			return &bestServers[0], nil
-		}
+	if !criteria.hasFilters() && !criteria.UseLatency {
+		return nil, fmt.Errorf("no server selected")
+	}
 
-	case useLatencyBasedSelection:
-		bestServers, err = FindBestServers(1)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find best server: %v", err)
-		}
-		if len(bestServers) > 0 {
-			return &bestServers[0], nil
-		}
+	pipeline, err := criteria.Pipeline(catalog)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("no server selected")
+	bestServers, err := pipeline.Select(ctx, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find best server: %v", err)
+	}
+	if len(bestServers) == 0 {
+		return nil, fmt.Errorf("no server selected")
+	}
+	return &bestServers[0], nil
 }
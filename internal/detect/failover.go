@@ -0,0 +1,65 @@
+package detect
+
+import "fmt"
+
+const (
+	// FailoverStay keeps replacement relays within the configured criteria.
+	FailoverStay = "stay"
+	// FailoverWiden searches the city, then the country, then every relay
+	// once the configured scope has no working relay left.
+	FailoverWiden = "widen"
+)
+
+// FailoverScopes returns the criteria to search, narrowest first, for a relay
+// to replace current. A pinned ServerName cannot fail over to anything, so it
+// is replaced by current's city and country. Owned, provider and exclude
+// constraints are kept in every scope.
+func (c Criteria) FailoverScopes(current *MullvadServer, policy string) ([]Criteria, error) {
+	base := c
+	base.ServerName = ""
+	base.UseLatency = true
+	if c.ServerName != "" && current != nil && c.CountryCode == "" && c.City == "" && c.Pattern == "" {
+		base.CountryCode = current.CountryCode
+		if current.CityCode != "" {
+			base.City = current.CountryCode + "-" + current.CityCode
+		}
+	}
+
+	scopes := []Criteria{base}
+	switch policy {
+	case "", FailoverStay:
+		return scopes, nil
+	case FailoverWiden:
+	default:
+		return nil, fmt.Errorf("unknown failover policy %q (valid choices: %s, %s)", policy, FailoverStay, FailoverWiden)
+	}
+
+	if base.CountryCode != "" && (base.City != "" || base.Pattern != "") {
+		country := base
+		country.City = ""
+		country.Pattern = ""
+		scopes = append(scopes, country)
+	}
+	if base.CountryCode != "" || base.City != "" || base.Pattern != "" {
+		global := base
+		global.CountryCode = ""
+		global.City = ""
+		global.Pattern = ""
+		scopes = append(scopes, global)
+	}
+	return scopes, nil
+}
+
+// ScopeName describes the geographic reach of the criteria for logging.
+func (c Criteria) ScopeName() string {
+	switch {
+	case c.City != "":
+		return "city " + c.City
+	case c.Pattern != "":
+		return "pattern " + c.Pattern
+	case c.CountryCode != "":
+		return "country " + c.CountryCode
+	default:
+		return "all relays"
+	}
+}
@@ -0,0 +1,134 @@
+package detect
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a hostname pattern as a regular expression instead of a glob.
+const regexPrefix = "re:"
+
+// ServerFilter narrows a relay list down to the servers that satisfy one rule.
+type ServerFilter func(servers []MullvadServer) ([]MullvadServer, error)
+
+// keep returns the servers for which match reports true.
+func keep(servers []MullvadServer, match func(MullvadServer) bool) []MullvadServer {
+	var kept []MullvadServer
+	for _, server := range servers {
+		if match(server) {
+			kept = append(kept, server)
+		}
+	}
+	return kept
+}
+
+// CountryFilter keeps servers in country, given as an ISO code or English name.
+func CountryFilter(country string) ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		code, err := matchCountry(servers, country)
+		if err != nil {
+			return nil, err
+		}
+		return keep(servers, func(server MullvadServer) bool {
+			return strings.EqualFold(server.CountryCode, code)
+		}), nil
+	}
+}
+
+// CityFilter keeps servers in city, given as "se-got", "got" or "Gothenburg".
+func CityFilter(city string) ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		return keep(servers, func(server MullvadServer) bool {
+			return matchCity(server, city)
+		}), nil
+	}
+}
+
+// PatternFilter keeps servers whose hostname matches a glob such as
+// "de-fra-wg-*", or a regular expression when prefixed with "re:".
+func PatternFilter(pattern string) ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		match, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return keep(servers, func(server MullvadServer) bool {
+			return match(server.Hostname)
+		}), nil
+	}
+}
+
+// OwnedFilter keeps servers owned by Mullvad rather than rented.
+func OwnedFilter() ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		return keep(servers, func(server MullvadServer) bool {
+			return server.Owned
+		}), nil
+	}
+}
+
+// ActiveFilter keeps servers the relay API reports as active.
+func ActiveFilter() ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		return keep(servers, func(server MullvadServer) bool {
+			return server.Active
+		}), nil
+	}
+}
+
+// ProviderFilter keeps servers hosted by one of providers.
+func ProviderFilter(providers ...string) ServerFilter {
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		return keep(servers, func(server MullvadServer) bool {
+			for _, provider := range providers {
+				if strings.EqualFold(server.Provider, provider) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	}
+}
+
+// ExcludeFilter drops servers whose hostname is in hostnames.
+func ExcludeFilter(hostnames ...string) ServerFilter {
+	excluded := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		excluded[strings.ToLower(hostname)] = true
+	}
+	return func(servers []MullvadServer) ([]MullvadServer, error) {
+		return keep(servers, func(server MullvadServer) bool {
+			return !excluded[strings.ToLower(server.Hostname)]
+		}), nil
+	}
+}
+
+// matchCity reports whether server is located in city.
+func matchCity(server MullvadServer, city string) bool {
+	city = strings.TrimSpace(city)
+	if country, code, ok := strings.Cut(city, "-"); ok && len(country) == 2 {
+		return strings.EqualFold(server.CountryCode, country) && strings.EqualFold(server.CityCode, code)
+	}
+	return strings.EqualFold(server.CityCode, city) || strings.EqualFold(server.CityName, city)
+}
+
+// compilePattern turns a hostname glob or "re:" regular expression into a matcher.
+func compilePattern(pattern string) (func(hostname string) bool, error) {
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostname regex %q: %v", expr, err)
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid hostname glob %q: %v", pattern, err)
+	}
+	return func(hostname string) bool {
+		matched, _ := path.Match(pattern, hostname)
+		return matched
+	}, nil
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package detect
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	icmpEchoRequest = 8
+	icmpEchoReply   = 0
+)
+
+// icmpPing sends one ICMP echo request through a SOCK_DGRAM ping socket and
+// waits for the matching reply. The kernel owns the echo identifier, so only
+// the sequence number is checked.
+func icmpPing(ctx context.Context, ip string, timeout time.Duration) (time.Duration, error) {
+	dst := net.ParseIP(ip).To4()
+	if dst == nil {
+		return 0, fmt.Errorf("invalid IPv4 address: %s", ip)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ping socket (check net.ipv4.ping_group_range): %w", err)
+	}
+	file := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ping socket: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	seq := uint16(rand.Intn(1 << 16))
+	request := make([]byte, 16)
+	request[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(request[6:], seq)
+	binary.BigEndian.PutUint64(request[8:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+
+	start := time.Now()
+	if _, err := conn.WriteTo(request, &net.UDPAddr{IP: dst}); err != nil {
+		return 0, err
+	}
+
+	reply := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(reply)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		if n >= 8 && reply[0] == icmpEchoReply && binary.BigEndian.Uint16(reply[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// icmpChecksum computes the RFC 1071 Internet checksum of b.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package detect
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// icmpPing is only implemented on Linux, which offers unprivileged ping sockets.
+func icmpPing(ctx context.Context, ip string, timeout time.Duration) (time.Duration, error) {
+	return 0, fmt.Errorf("ICMP probing is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,128 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+)
+
+// Catalog supplies the WireGuard relay list to the selection pipeline.
+// RelayCatalog is the production implementation.
+type Catalog interface {
+	FetchWireGuard(ctx context.Context) ([]MullvadServer, error)
+}
+
+// Pipeline selects servers by applying Filters in order to the catalog and
+// then ordering the survivors with Ranker.
+type Pipeline struct {
+	Catalog Catalog
+	Filters []ServerFilter
+	Ranker  Ranker
+}
+
+// Candidates returns the catalog servers that pass every filter, unranked.
+func (p *Pipeline) Candidates(ctx context.Context) ([]MullvadServer, error) {
+	servers, err := p.Catalog.FetchWireGuard(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.filter(servers)
+}
+
+// Select returns up to count servers, best first.
+func (p *Pipeline) Select(ctx context.Context, count int) ([]MullvadServer, error) {
+	servers, err := p.Candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ranker := p.Ranker
+	if ranker == nil {
+		ranker = LatencyRanker{Score: DefaultScoreWeights()}
+	}
+	ranked, err := ranker.Rank(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > len(ranked) {
+		count = len(ranked)
+	}
+	return ranked[:count], nil
+}
+
+// filter applies every filter in order, failing once nothing is left.
+func (p *Pipeline) filter(servers []MullvadServer) ([]MullvadServer, error) {
+	for _, filter := range p.Filters {
+		var err error
+		servers, err = filter(servers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers match the selection filters")
+	}
+	return servers, nil
+}
+
+// Criteria describes which relay SelectBestServer should pick.
+type Criteria struct {
+	// ServerName pins an exact hostname and bypasses every other criterion.
+	ServerName string
+	// CountryCode restricts selection to a country (ISO code or English name).
+	CountryCode string
+	// City restricts selection to a city, either "se-got", "got" or "Gothenburg".
+	City string
+	// Pattern restricts selection to hostnames matching a glob such as
+	// "de-fra-wg-*", or a regular expression when prefixed with "re:".
+	Pattern string
+	// OwnedOnly restricts selection to Mullvad-owned relays.
+	OwnedOnly bool
+	// Providers restricts selection to relays hosted by these providers.
+	Providers []string
+	// Exclude lists hostnames that must never be selected.
+	Exclude []string
+	// Ranking names the ranker: latency (default), jitter, load or random.
+	Ranking string
+	// UseLatency enables selection when no filter narrows the relay set.
+	UseLatency bool
+	// Probe tunes the latency sweep used by probing rankers.
+	Probe ProbeOptions
+	// Score weighs jitter and loss against median latency.
+	Score ScoreWeights
+}
+
+// hasFilters reports whether the criteria narrow the relay set.
+func (c Criteria) hasFilters() bool {
+	return c.CountryCode != "" || c.City != "" || c.Pattern != "" || c.OwnedOnly || len(c.Providers) > 0
+}
+
+// Pipeline builds the selection pipeline described by the criteria.
+func (c Criteria) Pipeline(catalog Catalog) (*Pipeline, error) {
+	ranker, err := NewRanker(c.Ranking, c.Probe, c.Score)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []ServerFilter
+	if c.CountryCode != "" {
+		filters = append(filters, CountryFilter(c.CountryCode))
+	}
+	if c.City != "" {
+		filters = append(filters, CityFilter(c.City))
+	}
+	if c.Pattern != "" {
+		filters = append(filters, PatternFilter(c.Pattern))
+	}
+	if c.OwnedOnly {
+		filters = append(filters, OwnedFilter())
+	}
+	if len(c.Providers) > 0 {
+		filters = append(filters, ProviderFilter(c.Providers...))
+	}
+	if len(c.Exclude) > 0 {
+		filters = append(filters, ExcludeFilter(c.Exclude...))
+	}
+
+	return &Pipeline{Catalog: catalog, Filters: filters, Ranker: ranker}, nil
+}
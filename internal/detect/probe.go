@@ -0,0 +1,171 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultProbeConcurrency is the number of relays probed in parallel.
+	DefaultProbeConcurrency = 50
+	// DefaultProbeTimeout bounds a single probe.
+	DefaultProbeTimeout = 500 * time.Millisecond
+	// DefaultProbeDeadline bounds a whole probe sweep.
+	DefaultProbeDeadline = 10 * time.Second
+	// DefaultProbeSamples is the number of probes sent to each relay.
+	DefaultProbeSamples = 3
+)
+
+// ProbeOptions tunes a latency sweep. Zero values select the defaults, except
+// Deadline where a negative value disables the sweep deadline.
+type ProbeOptions struct {
+	Concurrency int
+	Timeout     time.Duration
+	Deadline    time.Duration
+	Samples     int
+	// Prober measures each sample; nil selects TCPProber.
+	Prober Prober
+}
+
+// withDefaults fills unset options with their defaults.
+func (o ProbeOptions) withDefaults() ProbeOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultProbeConcurrency
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultProbeTimeout
+	}
+	if o.Deadline == 0 {
+		o.Deadline = DefaultProbeDeadline
+	}
+	if o.Samples <= 0 {
+		o.Samples = DefaultProbeSamples
+	}
+	if o.Prober == nil {
+		o.Prober = TCPProber{}
+	}
+	return o
+}
+
+// ProbeServers measures every server with opts.Samples round trips of opts.Prober.
+// Servers that never answer are left out of the result. When the sweep
+// deadline in opts expires the servers measured so far are returned;
+// cancellation of ctx itself aborts the sweep with ctx's error.
+func ProbeServers(ctx context.Context, servers []MullvadServer, opts ProbeOptions) ([]ServerLatency, error) {
+	opts = opts.withDefaults()
+	sweepCtx := ctx
+	if opts.Deadline > 0 {
+		var cancel context.CancelFunc
+		sweepCtx, cancel = context.WithTimeout(ctx, opts.Deadline)
+		defer cancel()
+	}
+
+	results := make(chan ServerLatency, len(servers))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, opts.Concurrency)
+
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server MullvadServer) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-sweepCtx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			var rtts []time.Duration
+			for i := 0; i < opts.Samples; i++ {
+				latency, err := opts.Prober.Probe(sweepCtx, server, opts.Timeout)
+				if sweepCtx.Err() != nil {
+					return
+				}
+				if err == nil {
+					rtts = append(rtts, latency)
+				}
+			}
+			if len(rtts) == 0 {
+				return
+			}
+
+			results <- newServerLatency(server, rtts, opts.Samples)
+		}(server)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-sweepCtx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var serverLatencies []ServerLatency
+	for len(results) > 0 {
+		serverLatencies = append(serverLatencies, <-results)
+	}
+
+	if len(serverLatencies) == 0 {
+		return nil, fmt.Errorf("no servers were successfully pinged")
+	}
+	return serverLatencies, nil
+}
+
+// newServerLatency summarises the round trips answered out of attempts probes.
+func newServerLatency(server MullvadServer, rtts []time.Duration, attempts int) ServerLatency {
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	median := percentile(sorted, 50)
+	server.Latency = median
+	return ServerLatency{
+		Server:  server,
+		Latency: median,
+		Min:     sorted[0],
+		Median:  median,
+		P95:     percentile(sorted, 95),
+		Jitter:  jitter(rtts),
+		Loss:    float64(attempts-len(rtts)) / float64(attempts),
+	}
+}
+
+// percentile returns the p-th percentile of sorted using linear interpolation
+// between closest ranks.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + time.Duration(frac*float64(sorted[lower+1]-sorted[lower]))
+}
+
+// jitter returns the mean absolute difference between consecutive samples.
+func jitter(rtts []time.Duration) time.Duration {
+	if len(rtts) < 2 {
+		return 0
+	}
+	var total time.Duration
+	for i := 1; i < len(rtts); i++ {
+		diff := rtts[i] - rtts[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		total += diff
+	}
+	return total / time.Duration(len(rtts)-1)
+}
@@ -0,0 +1,57 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultTCPProbePort is the relay port dialled by the TCP prober.
+	DefaultTCPProbePort = 443
+	// DefaultWireGuardPort is the relay port the tunnel and the WireGuard prober use.
+	DefaultWireGuardPort = 51820
+)
+
+// Prober measures one round trip to a relay.
+type Prober interface {
+	Probe(ctx context.Context, server MullvadServer, timeout time.Duration) (time.Duration, error)
+}
+
+// TCPProber measures the time to complete a TCP handshake with the relay.
+type TCPProber struct {
+	Port int
+}
+
+// Probe dials the relay over TCP.
+func (p TCPProber) Probe(ctx context.Context, server MullvadServer, timeout time.Duration) (time.Duration, error) {
+	port := p.Port
+	if port == 0 {
+		port = DefaultTCPProbePort
+	}
+	return TCPPingContext(ctx, server.IPv4AddrIn, port, timeout)
+}
+
+// ICMPProber sends an ICMP echo request over an unprivileged ping socket.
+// On Linux the caller's group must be within net.ipv4.ping_group_range.
+type ICMPProber struct{}
+
+// Probe pings the relay.
+func (ICMPProber) Probe(ctx context.Context, server MullvadServer, timeout time.Duration) (time.Duration, error) {
+	return icmpPing(ctx, server.IPv4AddrIn, timeout)
+}
+
+// NewProber returns the prober registered under method. The WireGuard prober
+// authenticates with privateKey, the base64 key registered with Mullvad; the
+// other probers ignore it. An empty method selects TCP.
+func NewProber(method, privateKey string) (Prober, error) {
+	switch method {
+	case "", "tcp":
+		return TCPProber{}, nil
+	case "icmp":
+		return ICMPProber{}, nil
+	case "wireguard":
+		return NewWireGuardProber(privateKey)
+	}
+	return nil, fmt.Errorf("unknown probe method %q (valid choices: tcp, icmp, wireguard)", method)
+}
@@ -0,0 +1,173 @@
+package detect
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Ranker orders a relay list from most to least preferred.
+type Ranker interface {
+	Rank(ctx context.Context, servers []MullvadServer) ([]MullvadServer, error)
+}
+
+const (
+	// DefaultJitterWeight is how much each unit of jitter adds to a score.
+	DefaultJitterWeight = 1.0
+	// DefaultLossPenalty is what a 100% loss ratio adds to a score.
+	DefaultLossPenalty = time.Second
+)
+
+// ScoreWeights turns a multi-sample measurement into a single comparable
+// score: median + JitterWeight*jitter + loss*LossPenalty. Lower is better.
+type ScoreWeights struct {
+	JitterWeight float64
+	LossPenalty  time.Duration
+}
+
+// DefaultScoreWeights returns the weights used when none are configured.
+func DefaultScoreWeights() ScoreWeights {
+	return ScoreWeights{JitterWeight: DefaultJitterWeight, LossPenalty: DefaultLossPenalty}
+}
+
+// Score computes the score of a measurement.
+func (w ScoreWeights) Score(result ServerLatency) time.Duration {
+	return result.Median +
+		time.Duration(w.JitterWeight*float64(result.Jitter)) +
+		time.Duration(result.Loss*float64(w.LossPenalty))
+}
+
+// LatencyRanker orders servers by their latency score.
+type LatencyRanker struct {
+	Probe ProbeOptions
+	Score ScoreWeights
+}
+
+// Rank probes every server and orders them by score.
+func (r LatencyRanker) Rank(ctx context.Context, servers []MullvadServer) ([]MullvadServer, error) {
+	results, err := ProbeServers(ctx, servers, r.Probe)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return r.Score.Score(results[i]) < r.Score.Score(results[j])
+	})
+	return serversOf(results), nil
+}
+
+// JitterRanker orders servers by the variation between round trips, breaking
+// ties on median latency.
+type JitterRanker struct {
+	Probe ProbeOptions
+}
+
+// Rank probes every server and orders them by jitter. At least two samples
+// are always taken so jitter is defined.
+func (r JitterRanker) Rank(ctx context.Context, servers []MullvadServer) ([]MullvadServer, error) {
+	opts := r.Probe
+	if opts.Samples < 2 {
+		opts.Samples = 2
+	}
+
+	results, err := ProbeServers(ctx, servers, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Jitter != results[j].Jitter {
+			return results[i].Jitter < results[j].Jitter
+		}
+		return results[i].Median < results[j].Median
+	})
+	return serversOf(results), nil
+}
+
+// LoadRanker orders servers by advertised network port speed, highest first.
+// The relay API does not publish live load, so port speed is used as the
+// capacity hint. It does not probe.
+type LoadRanker struct{}
+
+// Rank orders servers by port speed without probing them.
+func (LoadRanker) Rank(ctx context.Context, servers []MullvadServer) ([]MullvadServer, error) {
+	ranked := append([]MullvadServer(nil), servers...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].NetworkPortSpeed > ranked[j].NetworkPortSpeed
+	})
+	return ranked, nil
+}
+
+// RandomWeightedRanker shuffles servers so that relays with a faster network
+// port are proportionally more likely to come first, spreading clients across
+// relays instead of piling onto one.
+type RandomWeightedRanker struct {
+	// Rand is the source of randomness; nil uses a time-seeded source.
+	Rand *rand.Rand
+}
+
+// Rank returns servers in weighted random order without probing them.
+func (r RandomWeightedRanker) Rank(ctx context.Context, servers []MullvadServer) ([]MullvadServer, error) {
+	rng := r.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	remaining := append([]MullvadServer(nil), servers...)
+	ranked := make([]MullvadServer, 0, len(remaining))
+	for len(remaining) > 0 {
+		total := 0
+		for _, server := range remaining {
+			total += serverWeight(server)
+		}
+
+		pick := rng.Intn(total)
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			pick -= serverWeight(remaining[i])
+			if pick < 0 {
+				break
+			}
+		}
+
+		ranked = append(ranked, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ranked, nil
+}
+
+// serverWeight is the relative selection weight of server for random ranking.
+func serverWeight(server MullvadServer) int {
+	if server.NetworkPortSpeed > 0 {
+		return server.NetworkPortSpeed
+	}
+	return 1
+}
+
+// NewRanker returns the ranker registered under name, probing with opts and
+// scoring with weights where the ranker measures latency. An empty name
+// selects latency ranking.
+func NewRanker(name string, opts ProbeOptions, weights ScoreWeights) (Ranker, error) {
+	switch name {
+	case "", "latency":
+		return LatencyRanker{Probe: opts, Score: weights}, nil
+	case "jitter":
+		return JitterRanker{Probe: opts}, nil
+	case "load":
+		return LoadRanker{}, nil
+	case "random":
+		return RandomWeightedRanker{}, nil
+	}
+	return nil, fmt.Errorf("unknown ranking %q (valid choices: latency, jitter, load, random)", name)
+}
+
+// serversOf extracts the servers from probe results, preserving order.
+func serversOf(results []ServerLatency) []MullvadServer {
+	servers := make([]MullvadServer, len(results))
+	for i, result := range results {
+		servers[i] = result.Server
+	}
+	return servers
+}
@@ -0,0 +1,222 @@
+package detect
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	wgConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1    = "mac1----"
+
+	wgInitiationType = 1
+	wgResponseType   = 2
+	wgInitiationSize = 148
+	wgResponseSize   = 92
+	wgMAC1Offset     = 116
+)
+
+// WireGuardProber measures the round trip of a WireGuard handshake with the
+// relay over UDP, the same path the tunnel uses. Relays only answer peers
+// they know, so the private key must be one registered with Mullvad.
+type WireGuardProber struct {
+	Port       int
+	privateKey *ecdh.PrivateKey
+}
+
+// NewWireGuardProber creates a WireGuardProber from a base64 private key.
+func NewWireGuardProber(privateKey string) (*WireGuardProber, error) {
+	if privateKey == "" {
+		return nil, fmt.Errorf("wireguard probing requires a registered private key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return &WireGuardProber{privateKey: key}, nil
+}
+
+// Probe sends a handshake initiation and waits for the handshake response.
+func (p *WireGuardProber) Probe(ctx context.Context, server MullvadServer, timeout time.Duration) (time.Duration, error) {
+	port := p.Port
+	if port == 0 {
+		port = DefaultWireGuardPort
+	}
+
+	remoteRaw, err := base64.StdEncoding.DecodeString(server.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("invalid relay public key: %v", err)
+	}
+	remote, err := ecdh.X25519().NewPublicKey(remoteRaw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid relay public key: %v", err)
+	}
+
+	initiation, senderIndex, err := p.initiation(remote, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server.IPv4AddrIn, strconv.Itoa(port)))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if _, err := conn.Write(initiation); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 256)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		if n == wgResponseSize && response[0] == wgResponseType &&
+			binary.LittleEndian.Uint32(response[8:]) == senderIndex {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// initiation builds a Noise IK handshake initiation message addressed to
+// remote, following section 5.4.2 of the WireGuard paper.
+func (p *WireGuardProber) initiation(remote *ecdh.PublicKey, now time.Time) ([]byte, uint32, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var index [4]byte
+	if _, err := rand.Read(index[:]); err != nil {
+		return nil, 0, err
+	}
+	senderIndex := binary.LittleEndian.Uint32(index[:])
+
+	msg := make([]byte, wgInitiationSize)
+	msg[0] = wgInitiationType
+	binary.LittleEndian.PutUint32(msg[4:], senderIndex)
+
+	chain := blake2s.Sum256([]byte(wgConstruction))
+	h := wgHash(chain[:], []byte(wgIdentifier))
+	h = wgHash(h, remote.Bytes())
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	copy(msg[8:40], ephemeralPub)
+	c := wgKDF(chain[:], ephemeralPub, 1)[0]
+	h = wgHash(h, ephemeralPub)
+
+	shared, err := ephemeral.ECDH(remote)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := wgKDF(c, shared, 2)
+	c = keys[0]
+	encryptedStatic, err := wgSeal(keys[1], p.privateKey.PublicKey().Bytes(), h)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(msg[40:88], encryptedStatic)
+	h = wgHash(h, encryptedStatic)
+
+	shared, err = p.privateKey.ECDH(remote)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys = wgKDF(c, shared, 2)
+	encryptedTimestamp, err := wgSeal(keys[1], tai64n(now), h)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(msg[88:116], encryptedTimestamp)
+
+	macKey := wgHash([]byte(wgLabelMAC1), remote.Bytes())
+	mac, err := blake2s.New128(macKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	mac.Write(msg[:wgMAC1Offset])
+	copy(msg[wgMAC1Offset:], mac.Sum(nil))
+
+	return msg, senderIndex, nil
+}
+
+// wgHash is BLAKE2s-256 over the concatenation of parts.
+func wgHash(parts ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// wgKDF derives n keys from key and input with HMAC-BLAKE2s, as in HKDF.
+func wgKDF(key, input []byte, n int) [][]byte {
+	newHash := func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}
+	mac := hmac.New(newHash, key)
+	mac.Write(input)
+	prk := mac.Sum(nil)
+
+	var out [][]byte
+	var prev []byte
+	for i := 1; i <= n; i++ {
+		mac = hmac.New(newHash, prk)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i)})
+		prev = mac.Sum(nil)
+		out = append(out, prev)
+	}
+	return out
+}
+
+// wgSeal encrypts plaintext with ChaCha20-Poly1305 under a zero nonce.
+func wgSeal(key, plaintext, additional []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(nil, nonce, plaintext, additional), nil
+}
+
+// tai64n encodes t as a TAI64N timestamp.
+func tai64n(t time.Time) []byte {
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint64(out, 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(out[8:], uint32(t.Nanosecond()))
+	return out
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CgroupRoot is where the unified (v2) cgroup hierarchy is mounted.
+	CgroupRoot = "/sys/fs/cgroup"
+	// AppBypassTable is the nftables table that marks bypassed traffic.
+	AppBypassTable = "goguard_bypass"
+	// AppBypassMark is the fwmark given to traffic from bypassed cgroups.
+	AppBypassMark = 0x6767
+	// AppBypassRulePriority places the fwmark rule ahead of wg-quick's rules.
+	AppBypassRulePriority = 5100
+)
+
+// AppBypass sends the traffic of processes in the given cgroups around the
+// tunnel. Their packets are marked with AppBypassMark, looked up in the main
+// routing table by a policy rule and masqueraded, since the source address
+// was chosen for the tunnel before the mark rerouted them.
+//
+// nftables resolves cgroup paths when the rules are loaded, so a cgroup must
+// exist by then; cgroups that do not are skipped by Apply.
+type AppBypass struct {
+	Interface string
+	// Cgroups are paths relative to CgroupRoot, e.g. "system.slice/backup.service".
+	Cgroups []string
+	// DNS servers are only reachable through the tunnel and are never marked.
+	DNS []string
+}
+
+// Ruleset renders the nftables script that atomically replaces the bypass table.
+func (a *AppBypass) Ruleset() (string, error) {
+	if a.Interface == "" {
+		return "", fmt.Errorf("app bypass needs a tunnel interface")
+	}
+
+	var mark []string
+	for _, server := range a.DNS {
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			return "", fmt.Errorf("invalid DNS server %q: %v", server, err)
+		}
+		mark = append(mark, fmt.Sprintf("%s daddr %s return", ipFamily(addr), addr.Unmap()))
+	}
+	for _, cgroup := range a.Cgroups {
+		path, err := cleanCgroup(cgroup)
+		if err != nil {
+			return "", err
+		}
+		level := strings.Count(path, "/") + 1
+		mark = append(mark, fmt.Sprintf("socket cgroupv2 level %d %q meta mark set %#x", level, path, AppBypassMark))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\n", AppBypassTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", AppBypassTable)
+	fmt.Fprintf(&b, "table inet %s {\n", AppBypassTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype route hook output priority -150; policy accept;\n")
+	for _, rule := range mark {
+		fmt.Fprintf(&b, "\t\t%s\n", rule)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tmeta mark %#x oifname != %q masquerade\n", AppBypassMark, a.Interface)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// Apply installs the marking rules for the cgroups that exist and the policy
+// rules routing marked traffic via the main table. It returns the cgroups
+// that were skipped because they do not exist.
+func (a *AppBypass) Apply() ([]string, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("per-application split tunnelling is only supported on Linux")
+	}
+
+	present := *a
+	present.Cgroups = nil
+	var missing []string
+	for _, cgroup := range a.Cgroups {
+		path, err := cleanCgroup(cgroup)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(CgroupRoot, path)); err != nil {
+			missing = append(missing, cgroup)
+			continue
+		}
+		present.Cgroups = append(present.Cgroups, path)
+	}
+
+	ruleset, err := present.Ruleset()
+	if err != nil {
+		return nil, err
+	}
+	if err := runNft(ruleset); err != nil {
+		return nil, err
+	}
+
+	if err := removeRules(AppBypassRulePriority); err != nil {
+		return nil, fmt.Errorf("failed to replace app bypass rules: %v", err)
+	}
+	mark := strconv.Itoa(AppBypassMark)
+	for _, ipv6 := range []bool{false, true} {
+		if _, err := ipRule(ipv6, "add", "fwmark", mark, "lookup", "main", "priority", strconv.Itoa(AppBypassRulePriority)); err != nil {
+			return nil, fmt.Errorf("failed to add app bypass rule: %v", err)
+		}
+	}
+	return missing, nil
+}
+
+// RemoveAppBypass deletes the marking rules and the policy rules installed by
+// Apply. It is safe to call when they are not installed.
+func RemoveAppBypass() error {
+	if err := removeRules(AppBypassRulePriority); err != nil {
+		return fmt.Errorf("failed to remove app bypass rules: %v", err)
+	}
+	if !nftInstalled() {
+		return nil
+	}
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", AppBypassTable, AppBypassTable))
+}
+
+// CreateCgroup creates the cgroup if it does not exist and returns its directory.
+func CreateCgroup(cgroup string) (string, error) {
+	path, err := cleanCgroup(cgroup)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(CgroupRoot, path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup %s: %v", dir, err)
+	}
+	return dir, nil
+}
+
+// JoinCgroup creates the cgroup if needed and moves the process pid into it.
+// Children started afterwards inherit the cgroup.
+func JoinCgroup(cgroup string, pid int) error {
+	dir, err := CreateCgroup(cgroup)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("failed to join cgroup %s: %v", dir, err)
+	}
+	return nil
+}
+
+// cleanCgroup normalises a cgroup path relative to CgroupRoot and rejects
+// paths that cannot be quoted in an nftables rule.
+func cleanCgroup(cgroup string) (string, error) {
+	path := strings.Trim(filepath.Clean("/"+strings.TrimPrefix(cgroup, CgroupRoot)), "/")
+	if path == "" || strings.ContainsAny(path, "\"\\\n") {
+		return "", fmt.Errorf("invalid cgroup path %q", cgroup)
+	}
+	return path, nil
+}
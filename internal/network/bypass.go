@@ -0,0 +1,84 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// BypassRulePriority places the LAN bypass rules ahead of the rules wg-quick
+// installs, so local destinations are looked up in the main table.
+const BypassRulePriority = 5200
+
+// maxBypassRules bounds the cleanup loop in removeRules.
+const maxBypassRules = 256
+
+// AddBypassRules routes the given CIDRs via the main routing table instead of
+// the tunnel, keeping printers, NAS and SSH on the local network reachable.
+// Rules left over from a previous connection are replaced.
+func AddBypassRules(cidrs []string) error {
+	if runtime.GOOS != "linux" || len(cidrs) == 0 {
+		return nil
+	}
+	if err := RemoveBypassRules(); err != nil {
+		return err
+	}
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid local network %q: %v", cidr, err)
+		}
+		prefix = prefix.Masked()
+		if _, err := ipRule(prefix.Addr().Is6(), "add", "to", prefix.String(), "lookup", "main", "priority", strconv.Itoa(BypassRulePriority)); err != nil {
+			return fmt.Errorf("failed to add bypass rule for %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// RemoveBypassRules deletes every rule installed by AddBypassRules. It does
+// not need the CIDRs, so it also cleans up after a crash or a config change.
+func RemoveBypassRules() error {
+	if err := removeRules(BypassRulePriority); err != nil {
+		return fmt.Errorf("failed to remove bypass rules: %v", err)
+	}
+	return nil
+}
+
+// removeRules deletes every IPv4 and IPv6 rule at priority.
+func removeRules(priority int) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	for _, ipv6 := range []bool{false, true} {
+		for i := 0; i < maxBypassRules; i++ {
+			output, err := ipRule(ipv6, "del", "priority", strconv.Itoa(priority))
+			if err == nil {
+				continue
+			}
+			if strings.Contains(output, "No such file or directory") {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ipRule runs `ip rule` for the given address family.
+func ipRule(ipv6 bool, args ...string) (string, error) {
+	family := "-4"
+	if ipv6 {
+		family = "-6"
+	}
+	cmd := exec.Command("sudo", append([]string{"ip", family, "rule"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	return string(output), nil
+}
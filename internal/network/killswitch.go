@@ -0,0 +1,138 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// KillSwitchTable is the nftables table holding the kill switch rules.
+const KillSwitchTable = "goguard"
+
+// KillSwitch blocks all traffic that does not go through the tunnel. Only
+// the tunnel interface, loopback, the relay endpoints, the local networks,
+// bypassed applications, DHCP and IPv6 neighbour discovery are allowed. The table outlives the
+// process, so a crash or a dead tunnel keeps traffic blocked until
+// RemoveKillSwitch is called.
+type KillSwitch struct {
+	Interface string
+	// Endpoints are the relays the tunnel may talk to, as "ip:port".
+	Endpoints []string
+	// LocalNetworks are CIDRs reachable outside the tunnel.
+	LocalNetworks []string
+	// AllowBypassMark accepts traffic marked by AppBypass.
+	AllowBypassMark bool
+}
+
+// Ruleset renders the nftables script that atomically replaces the kill
+// switch table.
+func (k *KillSwitch) Ruleset() (string, error) {
+	if k.Interface == "" {
+		return "", fmt.Errorf("kill switch needs a tunnel interface")
+	}
+
+	var output, input []string
+	output = append(output,
+		`oifname "lo" accept`,
+		fmt.Sprintf("oifname %q accept", k.Interface),
+		"udp sport 68 udp dport 67 accept",
+		"icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept",
+	)
+	input = append(input,
+		`iifname "lo" accept`,
+		fmt.Sprintf("iifname %q accept", k.Interface),
+		"ct state established,related accept",
+		"udp sport 67 udp dport 68 accept",
+		"icmpv6 type { nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept",
+	)
+
+	for _, endpoint := range k.Endpoints {
+		addrPort, err := netip.ParseAddrPort(endpoint)
+		if err != nil {
+			return "", fmt.Errorf("invalid relay endpoint %q: %v", endpoint, err)
+		}
+		output = append(output, fmt.Sprintf("%s daddr %s udp dport %d accept",
+			ipFamily(addrPort.Addr()), addrPort.Addr().Unmap(), addrPort.Port()))
+	}
+
+	if k.AllowBypassMark {
+		output = append(output, fmt.Sprintf("meta mark %#x accept", AppBypassMark))
+	}
+
+	for _, cidr := range k.LocalNetworks {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid local network %q: %v", cidr, err)
+		}
+		prefix = prefix.Masked()
+		family := ipFamily(prefix.Addr())
+		output = append(output, fmt.Sprintf("%s daddr %s accept", family, prefix))
+		input = append(input, fmt.Sprintf("%s saddr %s accept", family, prefix))
+	}
+
+	var b strings.Builder
+	// Declaring the table first makes the delete succeed when it does not
+	// exist yet, so the whole script replaces the table in one transaction.
+	fmt.Fprintf(&b, "table inet %s\n", KillSwitchTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", KillSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", KillSwitchTable)
+	writeChain(&b, "output", output)
+	writeChain(&b, "input", input)
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// writeChain renders a filter chain that drops everything not accepted by rules.
+func writeChain(b *strings.Builder, hook string, rules []string) {
+	fmt.Fprintf(b, "\tchain %s {\n", hook)
+	fmt.Fprintf(b, "\t\ttype filter hook %s priority 0; policy drop;\n", hook)
+	for _, rule := range rules {
+		fmt.Fprintf(b, "\t\t%s\n", rule)
+	}
+	b.WriteString("\t}\n")
+}
+
+// ipFamily returns the nftables payload keyword for addr.
+func ipFamily(addr netip.Addr) string {
+	if addr.Unmap().Is4() {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// Apply installs the kill switch, replacing any previous rules so that
+// moving to another relay never leaves a gap.
+func (k *KillSwitch) Apply() error {
+	ruleset, err := k.Ruleset()
+	if err != nil {
+		return err
+	}
+	return runNft(ruleset)
+}
+
+// RemoveKillSwitch deletes the kill switch table. It is a no-op when the
+// table is absent or nftables is not installed.
+func RemoveKillSwitch() error {
+	if !nftInstalled() {
+		return nil
+	}
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", KillSwitchTable, KillSwitchTable))
+}
+
+// nftInstalled reports whether the nft tool is available.
+func nftInstalled() bool {
+	_, err := exec.LookPath("nft")
+	return err == nil
+}
+
+// runNft feeds script to `nft -f -`.
+func runNft(script string) error {
+	cmd := exec.Command("sudo", "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
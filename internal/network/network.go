@@ -3,23 +3,20 @@ package network
 import (
 	"fmt"
 	"io/ioutil"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
 
-// SetupRoutingAndDNS sets up the default route and DNS configuration based on the OS.
-func SetupRoutingAndDNS(interfaceName string, dnsServers []string) error {
-	// Only set the default route on Linux systems
-	if runtime.GOOS == "linux" {
-		err := SetDefaultRoute(interfaceName)
-		if err != nil {
-			return fmt.Errorf("failed to set default route: %v", err)
-		}
-	}
+// DNSBackupPath keeps the pre-connection resolver config so that a separate
+// `goguard down` invocation can restore it.
+const DNSBackupPath = "/var/lib/goguard/resolv.conf.orig"
 
+// SetupDNS points the system resolver at dnsServers on Linux. Routing is
+// left to the tunnel backend.
+func SetupDNS(dnsServers []string) error {
 	if runtime.GOOS == "linux" {
-
 		err := SetDNSConfig(dnsServers)
 		if err != nil {
 			return fmt.Errorf("failed to set DNS config: %v", err)
@@ -28,28 +25,6 @@ func SetupRoutingAndDNS(interfaceName string, dnsServers []string) error {
 	return nil
 }
 
-// SetDefaultRoute sets the default route to use the VPN interface
-func SetDefaultRoute(interfaceName string) error {
-	cmd := exec.Command("sudo", "route", "add", "default", interfaceName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to set default route: %v\nOutput: %s", err, string(output))
-	}
-	return nil
-}
-
-// RevertDefaultRoute reverts the default route back to the original interface
-func RevertDefaultRoute() error {
-	if runtime.GOOS == "linux" {
-		cmd := exec.Command("sudo", "route", "delete", "default")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("failed to delete default route: %v\nOutput: %s", err, string(output))
-		}
-	}
-	return nil
-}
-
 // SetDNSConfig sets the DNS servers for the system
 func SetDNSConfig(dnsServers []string) error {
 	resolvConf := "nameserver " + strings.Join(dnsServers, "\nnameserver ") + "\n"
@@ -79,3 +54,31 @@ func SaveOriginalDNSConfig() (string, error) {
 	}
 	return string(originalConfig), nil
 }
+
+// BackupDNSConfig persists the original DNS configuration to DNSBackupPath
+func BackupDNSConfig(originalConfig string) error {
+	if err := os.MkdirAll(filepath.Dir(DNSBackupPath), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := ioutil.WriteFile(DNSBackupPath, []byte(originalConfig), 0600); err != nil {
+		return fmt.Errorf("failed to back up DNS config: %v", err)
+	}
+	return nil
+}
+
+// LoadDNSBackup reads the DNS configuration saved by BackupDNSConfig
+func LoadDNSBackup() (string, error) {
+	originalConfig, err := ioutil.ReadFile(DNSBackupPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read DNS backup: %w", err)
+	}
+	return string(originalConfig), nil
+}
+
+// RemoveDNSBackup deletes the DNS backup once it has been restored
+func RemoveDNSBackup() error {
+	if err := os.Remove(DNSBackupPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove DNS backup: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// PrefixSet is a set of IPv4 and IPv6 addresses built from CIDR prefixes. It
+// is kept as sorted, non-overlapping, non-adjacent address ranges so that it
+// can be converted back into the fewest prefixes covering exactly the set.
+type PrefixSet struct {
+	ranges []addrRange
+}
+
+// addrRange is an inclusive range of addresses of one family.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// NewPrefixSet returns the union of prefixes.
+func NewPrefixSet(prefixes ...netip.Prefix) *PrefixSet {
+	s := &PrefixSet{}
+	for _, prefix := range prefixes {
+		s.Add(prefix)
+	}
+	return s
+}
+
+// ParsePrefixes parses CIDR strings such as "10.0.0.0/8" or "fd00::/8". A bare
+// address is taken as a single-host prefix.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid prefix %q: %v", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Add adds every address of prefix to the set.
+func (s *PrefixSet) Add(prefix netip.Prefix) {
+	s.ranges = append(s.ranges, prefixRange(prefix))
+	s.normalize()
+}
+
+// Remove removes every address of prefix from the set.
+func (s *PrefixSet) Remove(prefix netip.Prefix) {
+	cut := prefixRange(prefix)
+	var ranges []addrRange
+	for _, r := range s.ranges {
+		if cut.last.Less(r.first) || r.last.Less(cut.first) {
+			ranges = append(ranges, r)
+			continue
+		}
+		if r.first.Less(cut.first) {
+			ranges = append(ranges, addrRange{r.first, cut.first.Prev()})
+		}
+		if cut.last.Less(r.last) {
+			ranges = append(ranges, addrRange{cut.last.Next(), r.last})
+		}
+	}
+	s.ranges = ranges
+}
+
+// Contains reports whether addr is in the set.
+func (s *PrefixSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	i := sort.Search(len(s.ranges), func(i int) bool { return !s.ranges[i].last.Less(addr) })
+	return i < len(s.ranges) && !addr.Less(s.ranges[i].first)
+}
+
+// Prefixes returns the fewest prefixes that cover exactly the set, IPv4
+// first, each family in address order.
+func (s *PrefixSet) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range s.ranges {
+		prefixes = append(prefixes, r.prefixes()...)
+	}
+	return prefixes
+}
+
+// normalize sorts the ranges and merges those that overlap or touch.
+func (s *PrefixSet) normalize() {
+	sort.Slice(s.ranges, func(i, j int) bool { return s.ranges[i].first.Less(s.ranges[j].first) })
+
+	merged := s.ranges[:0]
+	for _, r := range s.ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			next := prev.last.Next()
+			// An invalid next means prev already ends at the family's last address.
+			if prev.first.BitLen() == r.first.BitLen() && (!next.IsValid() || !next.Less(r.first)) {
+				if prev.last.Less(r.last) {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	s.ranges = merged
+}
+
+// prefixRange returns the addresses covered by prefix.
+func prefixRange(prefix netip.Prefix) addrRange {
+	if prefix.Addr().Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			bits = 0
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+	}
+	prefix = prefix.Masked()
+	return addrRange{prefix.Addr(), lastAddr(prefix)}
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().As16()
+	offset := 128 - prefix.Addr().BitLen()
+	for bit := offset + prefix.Bits(); bit < 128; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr := netip.AddrFrom16(bytes)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// prefixes splits the range into the fewest aligned prefixes, greedily taking
+// the largest prefix that starts at the range's first address and fits.
+func (r addrRange) prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	first := r.first
+	for {
+		bits := first.BitLen()
+		for bits > 0 {
+			candidate := netip.PrefixFrom(first, bits-1)
+			if candidate.Masked().Addr() != first || r.last.Less(lastAddr(candidate)) {
+				break
+			}
+			bits--
+		}
+
+		prefix := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, prefix)
+
+		last := lastAddr(prefix)
+		if last == r.last {
+			return prefixes
+		}
+		first = last.Next()
+	}
+}
+
+// AllowedIPs computes the minimal AllowedIPs list routing include minus
+// exclude through the tunnel. An empty include means all of IPv4 and IPv6.
+func AllowedIPs(include, exclude []string) ([]netip.Prefix, error) {
+	if len(include) == 0 {
+		include = []string{"0.0.0.0/0", "::/0"}
+	}
+	included, err := ParsePrefixes(include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := ParsePrefixes(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	set := NewPrefixSet(included...)
+	for _, prefix := range excluded {
+		set.Remove(prefix)
+	}
+	return set.Prefixes(), nil
+}
+
+// FormatPrefixes formats prefixes as CIDR strings.
+func FormatPrefixes(prefixes []netip.Prefix) []string {
+	cidrs := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		cidrs[i] = prefix.String()
+	}
+	return cidrs
+}
@@ -0,0 +1,248 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RoutingStatePath keeps the routing snapshot taken before connecting, so
+// that `goguard down` or the next start after a crash can restore it.
+const RoutingStatePath = "/var/lib/goguard/routing.json"
+
+// ownedRulePriorities are the policy rule priorities GoGuard installs rules
+// at. Rules at any other priority belong to someone else.
+var ownedRulePriorities = map[int]bool{
+	AppBypassRulePriority:      true,
+	BypassRulePriority:         true,
+	TunnelSuppressRulePriority: true,
+	TunnelRulePriority:         true,
+}
+
+// RoutingSnapshot records the routing state GoGuard owns: the policy rules at
+// its priorities and the routes through the tunnel interface in the main and
+// tunnel tables. Restoring it puts exactly that state back after the tunnel
+// is gone, leaving routes and rules managed by anything else, such as DHCP or
+// other VPNs, untouched.
+type RoutingSnapshot struct {
+	TakenAt time.Time `json:"taken_at"`
+	// PID is the process that took the snapshot and owns the tunnel.
+	PID       int         `json:"pid"`
+	Interface string      `json:"interface"`
+	Routes    []RouteSpec `json:"routes"`
+	Rules     []RuleSpec  `json:"rules"`
+}
+
+// SaveRoutingSnapshot persists snapshot to RoutingStatePath. The file is
+// replaced atomically so a crash never leaves a truncated snapshot.
+func SaveRoutingSnapshot(snapshot *RoutingSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode routing snapshot: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(RoutingStatePath), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	tmp := RoutingStatePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save routing snapshot: %v", err)
+	}
+	if err := os.Rename(tmp, RoutingStatePath); err != nil {
+		return fmt.Errorf("failed to save routing snapshot: %v", err)
+	}
+	return nil
+}
+
+// LoadRoutingSnapshot reads the snapshot saved by SaveRoutingSnapshot.
+func LoadRoutingSnapshot() (*RoutingSnapshot, error) {
+	data, err := os.ReadFile(RoutingStatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing snapshot: %w", err)
+	}
+	var snapshot RoutingSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid routing snapshot %s: %v", RoutingStatePath, err)
+	}
+	return &snapshot, nil
+}
+
+// RemoveRoutingSnapshot deletes the saved snapshot once it has been restored.
+func RemoveRoutingSnapshot() error {
+	if err := os.Remove(RoutingStatePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove routing snapshot: %v", err)
+	}
+	return nil
+}
+
+// RouteSpec is a route through the tunnel interface. Device is a name rather
+// than an index so that a snapshot stays meaningful if interfaces are
+// recreated.
+type RouteSpec struct {
+	Family   int    `json:"family"`
+	Dst      string `json:"dst"`
+	Gateway  string `json:"gateway,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Scope    int    `json:"scope"`
+	Protocol int    `json:"protocol"`
+	Type     int    `json:"type"`
+	Table    int    `json:"table"`
+}
+
+// RuleSpec is a policy routing rule.
+type RuleSpec struct {
+	Family            int    `json:"family"`
+	Priority          int    `json:"priority"`
+	Table             int    `json:"table"`
+	Mark              uint32 `json:"mark,omitempty"`
+	Mask              uint32 `json:"mask,omitempty"`
+	HasMask           bool   `json:"has_mask,omitempty"`
+	Src               string `json:"src,omitempty"`
+	Dst               string `json:"dst,omitempty"`
+	IifName           string `json:"iif,omitempty"`
+	OifName           string `json:"oif,omitempty"`
+	SuppressPrefixlen int    `json:"suppress_prefixlen"`
+	Invert            bool   `json:"invert,omitempty"`
+}
+
+// RoutingChange is one step that brings the current routing state back to a
+// snapshot: either a route or a rule, to be added or deleted.
+type RoutingChange struct {
+	Add   bool
+	Route *RouteSpec
+	Rule  *RuleSpec
+}
+
+// String renders the route in `ip route` syntax.
+func (r RouteSpec) String() string {
+	parts := []string{r.Dst}
+	if r.Gateway != "" {
+		parts = append(parts, "via", r.Gateway)
+	}
+	if r.Device != "" {
+		parts = append(parts, "dev", r.Device)
+	}
+	if r.Source != "" {
+		parts = append(parts, "src", r.Source)
+	}
+	if r.Priority != 0 {
+		parts = append(parts, "metric", fmt.Sprint(r.Priority))
+	}
+	return strings.Join(parts, " ")
+}
+
+// String renders the rule in `ip rule` syntax.
+func (r RuleSpec) String() string {
+	parts := []string{fmt.Sprintf("%d:", r.Priority)}
+	if r.Invert {
+		parts = append(parts, "not")
+	}
+	if r.Src != "" {
+		parts = append(parts, "from", r.Src)
+	} else {
+		parts = append(parts, "from", "all")
+	}
+	if r.Dst != "" {
+		parts = append(parts, "to", r.Dst)
+	}
+	if r.Mark != 0 || r.HasMask {
+		mark := fmt.Sprintf("%#x", r.Mark)
+		if r.HasMask {
+			mark += fmt.Sprintf("/%#x", r.Mask)
+		}
+		parts = append(parts, "fwmark", mark)
+	}
+	if r.IifName != "" {
+		parts = append(parts, "iif", r.IifName)
+	}
+	if r.OifName != "" {
+		parts = append(parts, "oif", r.OifName)
+	}
+	parts = append(parts, "lookup", fmt.Sprint(r.Table))
+	if r.SuppressPrefixlen >= 0 {
+		parts = append(parts, "suppress_prefixlength", fmt.Sprint(r.SuppressPrefixlen))
+	}
+	return strings.Join(parts, " ")
+}
+
+// String renders the change as a +/- prefixed route or rule.
+func (c RoutingChange) String() string {
+	sign := "-"
+	if c.Add {
+		sign = "+"
+	}
+	if c.Route != nil {
+		return fmt.Sprintf("%s route %s", sign, c.Route)
+	}
+	return fmt.Sprintf("%s rule %s", sign, c.Rule)
+}
+
+// key identifies a route regardless of the order it was listed in.
+func (r RouteSpec) key() string {
+	return fmt.Sprintf("%d|%s|%s|%s|%s|%d|%d|%d|%d", r.Family, r.Dst, r.Gateway, r.Source, r.Device, r.Priority, r.Scope, r.Type, r.Table)
+}
+
+// key identifies a rule regardless of the order it was listed in.
+func (r RuleSpec) key() string {
+	return fmt.Sprintf("%d|%d|%d|%d|%d|%t|%s|%s|%s|%s|%d|%t", r.Family, r.Priority, r.Table, r.Mark, r.Mask, r.HasMask, r.Src, r.Dst, r.IifName, r.OifName, r.SuppressPrefixlen, r.Invert)
+}
+
+// ownsRoute reports whether route goes through the snapshot's tunnel
+// interface. Routes on any other link are never added or deleted.
+func (s *RoutingSnapshot) ownsRoute(route RouteSpec) bool {
+	return s.Interface != "" && route.Device == s.Interface
+}
+
+// diffRouting returns the changes turning the GoGuard-owned part of current
+// into want: deletions of what want lacks first, then additions of what
+// current lacks. Routes on other links and rules at other priorities are
+// ignored, even if they appear in either snapshot.
+func diffRouting(current, want *RoutingSnapshot) []RoutingChange {
+	var changes []RoutingChange
+
+	wantRoutes := make(map[string]bool, len(want.Routes))
+	for _, route := range want.Routes {
+		wantRoutes[route.key()] = true
+	}
+	currentRoutes := make(map[string]bool, len(current.Routes))
+	for i, route := range current.Routes {
+		if !want.ownsRoute(route) {
+			continue
+		}
+		currentRoutes[route.key()] = true
+		if !wantRoutes[route.key()] {
+			changes = append(changes, RoutingChange{Route: &current.Routes[i]})
+		}
+	}
+
+	wantRules := make(map[string]bool, len(want.Rules))
+	for _, rule := range want.Rules {
+		wantRules[rule.key()] = true
+	}
+	currentRules := make(map[string]bool, len(current.Rules))
+	for i, rule := range current.Rules {
+		if !ownedRulePriorities[rule.Priority] {
+			continue
+		}
+		currentRules[rule.key()] = true
+		if !wantRules[rule.key()] {
+			changes = append(changes, RoutingChange{Rule: &current.Rules[i]})
+		}
+	}
+
+	for i, route := range want.Routes {
+		if want.ownsRoute(route) && !currentRoutes[route.key()] {
+			changes = append(changes, RoutingChange{Add: true, Route: &want.Routes[i]})
+		}
+	}
+	for i, rule := range want.Rules {
+		if ownedRulePriorities[rule.Priority] && !currentRules[rule.key()] {
+			changes = append(changes, RoutingChange{Add: true, Rule: &want.Rules[i]})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,289 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// SnapshotRouting records the routing state GoGuard owns for interfaceName:
+// the routes through the interface in the main and tunnel tables, and the
+// policy rules at GoGuard's priorities. Before connecting the interface
+// usually does not exist yet and only rules are recorded.
+func SnapshotRouting(interfaceName string) (*RoutingSnapshot, error) {
+	snapshot := &RoutingSnapshot{TakenAt: time.Now(), PID: os.Getpid(), Interface: interfaceName}
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil && !errors.As(err, &netlink.LinkNotFoundError{}) {
+		return nil, fmt.Errorf("failed to look up interface %s: %v", interfaceName, err)
+	}
+
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		if link != nil {
+			filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_UNSPEC}
+			routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list routes: %v", err)
+			}
+			for _, route := range routes {
+				if len(route.MultiPath) > 0 || (route.Table != unix.RT_TABLE_MAIN && route.Table != DefaultTunnelTable) {
+					continue
+				}
+				snapshot.Routes = append(snapshot.Routes, routeSpec(family, route, interfaceName))
+			}
+		}
+
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, rule := range rules {
+			if ownedRulePriorities[rule.Priority] && representable(rule) {
+				snapshot.Rules = append(snapshot.Rules, ruleSpec(family, rule))
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// representable reports whether rule uses only the selectors RuleSpec
+// records, as every rule GoGuard installs does. Other rules are skipped
+// rather than restored broader than they were.
+func representable(rule netlink.Rule) bool {
+	return rule.Tos == 0 && rule.TunID == 0 && rule.Goto < 0 && rule.Flow < 0 &&
+		rule.SuppressIfgroup < 0 && rule.Dport == nil && rule.Sport == nil &&
+		rule.IPProto == 0 && rule.UIDRange == nil
+}
+
+// FromCurrentBoot reports whether the snapshot was taken since the system
+// last booted. An older snapshot describes routing that no longer exists.
+func (s *RoutingSnapshot) FromCurrentBoot() bool {
+	booted, err := bootTime()
+	if err != nil {
+		return false
+	}
+	return s.TakenAt.After(booted)
+}
+
+// OwnerRunning reports whether the process that took the snapshot is still
+// running, other than the calling process.
+func (s *RoutingSnapshot) OwnerRunning() bool {
+	if s.PID <= 0 || s.PID == os.Getpid() {
+		return false
+	}
+	return unix.Kill(s.PID, 0) != unix.ESRCH
+}
+
+// bootTime reads when the system booted from /proc/stat.
+func bootTime() (time.Time, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid btime %q: %v", value, err)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+// Restore puts the GoGuard-owned routing state back to the snapshot,
+// deleting routes and rules added since and re-adding those removed. Routes
+// through an interface that no longer exists cannot be restored and are
+// reported.
+func (s *RoutingSnapshot) Restore() error {
+	changes, err := s.Diff()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, change := range changes {
+		if err := applyRoutingChange(change); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Diff returns the changes Restore would make.
+func (s *RoutingSnapshot) Diff() ([]RoutingChange, error) {
+	current, err := SnapshotRouting(s.Interface)
+	if err != nil {
+		return nil, err
+	}
+	return diffRouting(current, s), nil
+}
+
+// applyRoutingChange adds or deletes one route or rule.
+func applyRoutingChange(change RoutingChange) error {
+	if change.Route != nil {
+		route, err := netlinkRoute(*change.Route)
+		if err != nil {
+			return err
+		}
+		if change.Add {
+			if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("failed to restore route %s: %v", change.Route, err)
+			}
+			return nil
+		}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("failed to delete route %s: %v", change.Route, err)
+		}
+		return nil
+	}
+
+	rule, err := netlinkRule(*change.Rule)
+	if err != nil {
+		return err
+	}
+	if change.Add {
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to restore rule %s: %v", change.Rule, err)
+		}
+		return nil
+	}
+	if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to delete rule %s: %v", change.Rule, err)
+	}
+	return nil
+}
+
+// routeSpec converts a route through device to its snapshot form.
+func routeSpec(family int, route netlink.Route, device string) RouteSpec {
+	spec := RouteSpec{
+		Family:   family,
+		Dst:      defaultDst(family),
+		Priority: route.Priority,
+		Scope:    int(route.Scope),
+		Protocol: int(route.Protocol),
+		Type:     route.Type,
+		Table:    route.Table,
+		Device:   device,
+	}
+	if route.Dst != nil {
+		spec.Dst = route.Dst.String()
+	}
+	if route.Gw != nil {
+		spec.Gateway = route.Gw.String()
+	}
+	if route.Src != nil {
+		spec.Source = route.Src.String()
+	}
+	return spec
+}
+
+// netlinkRoute converts a snapshot route back to a netlink route.
+func netlinkRoute(spec RouteSpec) (*netlink.Route, error) {
+	route := &netlink.Route{
+		Family:   spec.Family,
+		Priority: spec.Priority,
+		Scope:    netlink.Scope(spec.Scope),
+		Protocol: netlink.RouteProtocol(spec.Protocol),
+		Type:     spec.Type,
+		Table:    spec.Table,
+		Gw:       net.ParseIP(spec.Gateway),
+		Src:      net.ParseIP(spec.Source),
+	}
+	if spec.Dst != defaultDst(spec.Family) {
+		_, dst, err := net.ParseCIDR(spec.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route destination %q: %v", spec.Dst, err)
+		}
+		route.Dst = dst
+	}
+	if spec.Device != "" {
+		link, err := netlink.LinkByName(spec.Device)
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore route %s: %v", spec, err)
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	return route, nil
+}
+
+// ruleSpec converts a listed rule to its snapshot form.
+func ruleSpec(family int, rule netlink.Rule) RuleSpec {
+	spec := RuleSpec{
+		Family:            family,
+		Priority:          rule.Priority,
+		Table:             rule.Table,
+		Mark:              rule.Mark,
+		IifName:           rule.IifName,
+		OifName:           rule.OifName,
+		SuppressPrefixlen: rule.SuppressPrefixlen,
+		Invert:            rule.Invert,
+	}
+	if rule.Mask != nil {
+		spec.Mask = *rule.Mask
+		spec.HasMask = true
+	}
+	if rule.Src != nil {
+		spec.Src = rule.Src.String()
+	}
+	if rule.Dst != nil {
+		spec.Dst = rule.Dst.String()
+	}
+	return spec
+}
+
+// netlinkRule converts a snapshot rule back to a netlink rule.
+func netlinkRule(spec RuleSpec) (*netlink.Rule, error) {
+	rule := netlink.NewRule()
+	rule.Family = spec.Family
+	rule.Priority = spec.Priority
+	rule.Table = spec.Table
+	rule.Mark = spec.Mark
+	rule.IifName = spec.IifName
+	rule.OifName = spec.OifName
+	rule.SuppressPrefixlen = spec.SuppressPrefixlen
+	rule.Invert = spec.Invert
+	if spec.HasMask {
+		mask := spec.Mask
+		rule.Mask = &mask
+	}
+	for _, field := range []struct {
+		value  string
+		target **net.IPNet
+	}{{spec.Src, &rule.Src}, {spec.Dst, &rule.Dst}} {
+		if field.value == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule selector %q: %v", field.value, err)
+		}
+		*field.target = ipNet
+	}
+	return rule, nil
+}
+
+// defaultDst is how a default route's destination is recorded.
+func defaultDst(family int) string {
+	if family == unix.AF_INET6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
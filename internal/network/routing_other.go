@@ -0,0 +1,28 @@
+//go:build !linux
+
+package network
+
+// SnapshotRouting is only supported on Linux.
+func SnapshotRouting(interfaceName string) (*RoutingSnapshot, error) {
+	return nil, errNoNetlink
+}
+
+// FromCurrentBoot is only supported on Linux.
+func (s *RoutingSnapshot) FromCurrentBoot() bool {
+	return false
+}
+
+// OwnerRunning is only supported on Linux.
+func (s *RoutingSnapshot) OwnerRunning() bool {
+	return false
+}
+
+// Restore is only supported on Linux.
+func (s *RoutingSnapshot) Restore() error {
+	return errNoNetlink
+}
+
+// Diff is only supported on Linux.
+func (s *RoutingSnapshot) Diff() ([]RoutingChange, error) {
+	return nil, errNoNetlink
+}
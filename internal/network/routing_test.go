@@ -0,0 +1,93 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRouting(t *testing.T) {
+	const (
+		inet  = 2
+		inet6 = 10
+	)
+	lanBypass := RuleSpec{Family: inet, Priority: BypassRulePriority, Table: 254, Dst: "192.168.1.0/24", SuppressPrefixlen: -1}
+	suppress := RuleSpec{Family: inet, Priority: TunnelSuppressRulePriority, Table: 254, SuppressPrefixlen: 0}
+	tunnel := RuleSpec{Family: inet6, Priority: TunnelRulePriority, Table: DefaultTunnelTable, Mark: DefaultTunnelFwmark, Invert: true, SuppressPrefixlen: -1}
+	foreignRule := RuleSpec{Family: inet, Priority: 1000, Table: 100, SuppressPrefixlen: -1}
+	tunnelRoute := RouteSpec{Family: inet, Dst: "0.0.0.0/0", Device: "wg0", Table: DefaultTunnelTable}
+	mainRoute := RouteSpec{Family: inet, Dst: "10.0.0.0/8", Device: "wg0", Table: 254}
+	uplink := RouteSpec{Family: inet, Dst: "0.0.0.0/0", Gateway: "192.0.2.1", Device: "eth0", Table: 254}
+	oldUplink := RouteSpec{Family: inet, Dst: "0.0.0.0/0", Gateway: "198.51.100.1", Device: "eth0", Table: 254}
+
+	tests := []struct {
+		name    string
+		current RoutingSnapshot
+		want    RoutingSnapshot
+		changes []string
+	}{
+		{
+			name:    "unchanged",
+			current: RoutingSnapshot{Interface: "wg0", Rules: []RuleSpec{lanBypass}},
+			want:    RoutingSnapshot{Interface: "wg0", Rules: []RuleSpec{lanBypass}},
+		},
+		{
+			name: "tunnel state added since is deleted",
+			current: RoutingSnapshot{
+				Interface: "wg0",
+				Routes:    []RouteSpec{tunnelRoute, mainRoute},
+				Rules:     []RuleSpec{suppress, tunnel},
+			},
+			want: RoutingSnapshot{Interface: "wg0"},
+			changes: []string{
+				"- route 0.0.0.0/0 dev wg0",
+				"- route 10.0.0.0/8 dev wg0",
+				"- rule 5250: from all lookup 254 suppress_prefixlength 0",
+				"- rule 5300: not from all fwmark 0xca6c lookup 51820",
+			},
+		},
+		{
+			name: "routes on other links and rules at other priorities are left alone",
+			current: RoutingSnapshot{
+				Interface: "wg0",
+				Routes:    []RouteSpec{uplink},
+				Rules:     []RuleSpec{foreignRule},
+			},
+			want: RoutingSnapshot{
+				Interface: "wg0",
+				Routes:    []RouteSpec{oldUplink},
+			},
+		},
+		{
+			name:    "removed rule is restored after deletions",
+			current: RoutingSnapshot{Interface: "wg0", Rules: []RuleSpec{suppress}},
+			want:    RoutingSnapshot{Interface: "wg0", Rules: []RuleSpec{lanBypass}},
+			changes: []string{
+				"- rule 5250: from all lookup 254 suppress_prefixlength 0",
+				"+ rule 5200: from all to 192.168.1.0/24 lookup 254",
+			},
+		},
+		{
+			name:    "route through the tunnel is restored",
+			current: RoutingSnapshot{Interface: "wg0"},
+			want:    RoutingSnapshot{Interface: "wg0", Routes: []RouteSpec{mainRoute}},
+			changes: []string{"+ route 10.0.0.0/8 dev wg0"},
+		},
+		{
+			name:    "snapshot without an interface owns no routes",
+			current: RoutingSnapshot{Routes: []RouteSpec{mainRoute}},
+			want:    RoutingSnapshot{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []string
+			for _, change := range diffRouting(&tt.current, &tt.want) {
+				changes = append(changes, change.String())
+			}
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("diffRouting() = %q, want %q", changes, tt.changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTunnelTable is the routing table holding the tunnel routes. It
+	// and DefaultTunnelFwmark match wg-quick, so the kill switch and bypass
+	// rules work the same with either backend.
+	DefaultTunnelTable = 51820
+	// DefaultTunnelFwmark marks the tunnel's own encrypted packets so that
+	// they are routed via the main table instead of looping into the tunnel.
+	DefaultTunnelFwmark = 51820
+	// DefaultTunnelMTU leaves room for the WireGuard overhead on a 1500 byte link.
+	DefaultTunnelMTU = 1420
+	// TunnelSuppressRulePriority looks up the main table ignoring its default
+	// route, so local and more specific routes still win over the tunnel.
+	TunnelSuppressRulePriority = 5250
+	// TunnelRulePriority sends everything not marked by WireGuard itself to
+	// the tunnel table.
+	TunnelRulePriority = 5300
+)
+
+// TunnelConfig describes a WireGuard interface in the terms of a wg-quick
+// config file.
+type TunnelConfig struct {
+	Interface  string
+	PrivateKey string
+	Addresses  []netip.Prefix
+	MTU        int
+	Table      int
+	Fwmark     int
+	Peers      []TunnelPeer
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+}
+
+// TunnelPeer is a WireGuard peer to configure on an interface.
+type TunnelPeer struct {
+	PublicKey string
+	// Endpoint is "ip:port"; empty leaves the endpoint unchanged.
+	Endpoint   string
+	AllowedIPs []netip.Prefix
+	// PersistentKeepalive of zero turns keepalives off.
+	PersistentKeepalive time.Duration
+}
+
+// TunnelPeerStats are the counters of a peer on a running interface.
+type TunnelPeerStats struct {
+	PublicKey string
+	Endpoint  string
+	// LatestHandshake is zero when no handshake has completed yet.
+	LatestHandshake time.Time
+	AllowedIPs      []netip.Prefix
+	RxBytes         uint64
+	TxBytes         uint64
+}
+
+// ParseWireGuardConfig parses a wg-quick config file for interfaceName. DNS
+// and SaveConfig are left to the caller; unset MTU, Table and FwMark get the
+// defaults above.
+func ParseWireGuardConfig(interfaceName, content string) (*TunnelConfig, error) {
+	cfg := &TunnelConfig{
+		Interface: interfaceName,
+		MTU:       DefaultTunnelMTU,
+		Table:     DefaultTunnelTable,
+		Fwmark:    DefaultTunnelFwmark,
+	}
+
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			if section == "peer" {
+				cfg.Peers = append(cfg.Peers, TunnelPeer{})
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = cfg.setInterfaceKey(key, value)
+		case "peer":
+			err = cfg.Peers[len(cfg.Peers)-1].setKey(key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if cfg.PrivateKey == "" {
+		return nil, fmt.Errorf("no PrivateKey in [Interface]")
+	}
+	return cfg, nil
+}
+
+// setInterfaceKey applies one [Interface] setting.
+func (c *TunnelConfig) setInterfaceKey(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		c.PrivateKey = value
+	case "address":
+		c.Addresses, err = parseAddressList(value)
+	case "mtu":
+		c.MTU, err = strconv.Atoi(value)
+	case "table":
+		if value != "auto" {
+			c.Table, err = strconv.Atoi(value)
+		}
+	case "fwmark":
+		var mark int64
+		mark, err = strconv.ParseInt(value, 0, 32)
+		c.Fwmark = int(mark)
+	case "preup":
+		c.PreUp = append(c.PreUp, value)
+	case "postup":
+		c.PostUp = append(c.PostUp, value)
+	case "predown":
+		c.PreDown = append(c.PreDown, value)
+	case "postdown":
+		c.PostDown = append(c.PostDown, value)
+	case "dns", "saveconfig", "listenport":
+	default:
+		return fmt.Errorf("unknown [Interface] key %q", key)
+	}
+	return err
+}
+
+// setKey applies one [Peer] setting.
+func (p *TunnelPeer) setKey(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		p.PublicKey = value
+	case "endpoint":
+		if _, err = netip.ParseAddrPort(value); err == nil {
+			p.Endpoint = value
+		}
+	case "allowedips":
+		p.AllowedIPs, err = parseAddressList(value)
+	case "persistentkeepalive":
+		if value != "off" {
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			p.PersistentKeepalive = time.Duration(seconds) * time.Second
+		}
+	case "presharedkey":
+		return fmt.Errorf("preshared keys are not supported")
+	default:
+		return fmt.Errorf("unknown [Peer] key %q", key)
+	}
+	return err
+}
+
+// parseAddressList parses a comma-separated list of prefixes or addresses.
+func parseAddressList(value string) ([]netip.Prefix, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return ParsePrefixes(fields)
+}
@@ -0,0 +1,276 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// srcValidMarkPath lets reverse path filtering take the fwmark into account,
+// as wg-quick does, so replies to the tunnel's encrypted packets are accepted.
+const srcValidMarkPath = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+
+// CreateTunnel creates the WireGuard interface described by cfg, configures
+// its key and peers, assigns its addresses, routes the peers' allowed IPs
+// through it and installs the policy rules that send traffic to it. Nothing is
+// left behind if a step fails.
+func CreateTunnel(cfg *TunnelConfig) (err error) {
+	privateKey, err := wgtypes.ParseKey(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = cfg.Interface
+	attrs.MTU = cfg.MTU
+	link := &netlink.Wireguard{LinkAttrs: attrs}
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("failed to create interface %s: %v", cfg.Interface, err)
+	}
+	defer func() {
+		if err != nil {
+			if cleanupErr := DeleteTunnel(cfg.Interface); cleanupErr != nil {
+				err = errors.Join(err, cleanupErr)
+			}
+		}
+	}()
+
+	peers := make([]wgtypes.PeerConfig, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		peerConfig, err := peerConfig(peer)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peerConfig)
+	}
+	if err := configureDevice(cfg.Interface, wgtypes.Config{
+		PrivateKey:   &privateKey,
+		FirewallMark: &cfg.Fwmark,
+		ReplacePeers: true,
+		Peers:        peers,
+	}); err != nil {
+		return err
+	}
+
+	for _, address := range cfg.Addresses {
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: prefixIPNet(address)}); err != nil {
+			return fmt.Errorf("failed to add address %s: %v", address, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up interface %s: %v", cfg.Interface, err)
+	}
+
+	families := make(map[int]bool)
+	for _, peer := range cfg.Peers {
+		for _, prefix := range peer.AllowedIPs {
+			route := &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst:       prefixIPNet(prefix.Masked()),
+				Scope:     netlink.SCOPE_LINK,
+				Table:     cfg.Table,
+			}
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to route %s through %s: %v", prefix, cfg.Interface, err)
+			}
+			families[prefixFamily(prefix)] = true
+		}
+	}
+
+	if families[unix.AF_INET] {
+		if err := os.WriteFile(srcValidMarkPath, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable src_valid_mark: %v", err)
+		}
+	}
+	for family := range families {
+		if err := addTunnelRules(family, cfg.Table, cfg.Fwmark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTunnelRules installs the wg-quick style rule pair for one family.
+func addTunnelRules(family, table, fwmark int) error {
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Priority = TunnelSuppressRulePriority
+	suppress.Table = unix.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+	if err := netlink.RuleAdd(suppress); err != nil {
+		return fmt.Errorf("failed to add main table rule: %v", err)
+	}
+
+	tunnel := netlink.NewRule()
+	tunnel.Family = family
+	tunnel.Priority = TunnelRulePriority
+	tunnel.Table = table
+	tunnel.Mark = uint32(fwmark)
+	tunnel.Invert = true
+	if err := netlink.RuleAdd(tunnel); err != nil {
+		return fmt.Errorf("failed to add tunnel rule: %v", err)
+	}
+	return nil
+}
+
+// DeleteTunnel removes the tunnel's policy rules and the interface, which
+// takes its addresses and routes with it. Missing pieces are skipped.
+func DeleteTunnel(interfaceName string) error {
+	var errs []error
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list rules: %v", err))
+			continue
+		}
+		for i := range rules {
+			if rules[i].Priority != TunnelSuppressRulePriority && rules[i].Priority != TunnelRulePriority {
+				continue
+			}
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete rule %s: %v", rules[i], err))
+			}
+		}
+	}
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete interface %s: %v", interfaceName, err))
+		}
+	} else if !errors.As(err, &netlink.LinkNotFoundError{}) {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ConfigureTunnelPeer adds peer to the interface or updates it. Its allowed
+// IPs are replaced, which takes them away from any other peer.
+func ConfigureTunnelPeer(interfaceName string, peer TunnelPeer) error {
+	config, err := peerConfig(peer)
+	if err != nil {
+		return err
+	}
+	return configureDevice(interfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{config}})
+}
+
+// RemoveTunnelPeer removes the peer with publicKey from the interface.
+func RemoveTunnelPeer(interfaceName, publicKey string) error {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key %q: %v", publicKey, err)
+	}
+	return configureDevice(interfaceName, wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}}})
+}
+
+// TunnelPeers returns the peers of the interface and their counters.
+func TunnelPeers(interfaceName string) ([]TunnelPeerStats, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WireGuard control: %v", err)
+	}
+	defer client.Close()
+
+	device, err := client.Device(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard device %s: %v", interfaceName, err)
+	}
+
+	peers := make([]TunnelPeerStats, 0, len(device.Peers))
+	for _, peer := range device.Peers {
+		stats := TunnelPeerStats{
+			PublicKey: peer.PublicKey.String(),
+			RxBytes:   uint64(peer.ReceiveBytes),
+			TxBytes:   uint64(peer.TransmitBytes),
+		}
+		if peer.Endpoint != nil {
+			stats.Endpoint = peer.Endpoint.String()
+		}
+		if !peer.LastHandshakeTime.IsZero() && peer.LastHandshakeTime.Unix() > 0 {
+			stats.LatestHandshake = peer.LastHandshakeTime
+		}
+		for _, ipNet := range peer.AllowedIPs {
+			if prefix, ok := ipNetPrefix(ipNet); ok {
+				stats.AllowedIPs = append(stats.AllowedIPs, prefix)
+			}
+		}
+		peers = append(peers, stats)
+	}
+	return peers, nil
+}
+
+// configureDevice applies config to the interface through wgctrl.
+func configureDevice(interfaceName string, config wgtypes.Config) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("failed to open WireGuard control: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.ConfigureDevice(interfaceName, config); err != nil {
+		return fmt.Errorf("failed to configure WireGuard device %s: %v", interfaceName, err)
+	}
+	return nil
+}
+
+// peerConfig converts peer into its wgctrl form.
+func peerConfig(peer TunnelPeer) (wgtypes.PeerConfig, error) {
+	key, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("invalid public key %q: %v", peer.PublicKey, err)
+	}
+
+	keepalive := peer.PersistentKeepalive
+	config := wgtypes.PeerConfig{
+		PublicKey:                   key,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	}
+	if peer.Endpoint != "" {
+		endpoint, err := netip.ParseAddrPort(peer.Endpoint)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid endpoint %q: %v", peer.Endpoint, err)
+		}
+		config.Endpoint = net.UDPAddrFromAddrPort(endpoint)
+	}
+	for _, prefix := range peer.AllowedIPs {
+		config.AllowedIPs = append(config.AllowedIPs, *prefixIPNet(prefix.Masked()))
+	}
+	return config, nil
+}
+
+// prefixIPNet converts prefix to a *net.IPNet, keeping host bits.
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	addr := prefix.Addr().Unmap()
+	return &net.IPNet{
+		IP:   net.IP(addr.AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), addr.BitLen()),
+	}
+}
+
+// ipNetPrefix converts ipNet to a netip.Prefix.
+func ipNetPrefix(ipNet net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := ipNet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones), true
+}
+
+// prefixFamily returns the address family of prefix.
+func prefixFamily(prefix netip.Prefix) int {
+	if prefix.Addr().Unmap().Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package network
+
+import "fmt"
+
+// errNoNetlink is returned by the netlink backend on systems without netlink.
+var errNoNetlink = fmt.Errorf("the netlink backend is only supported on Linux")
+
+// CreateTunnel is only supported on Linux.
+func CreateTunnel(cfg *TunnelConfig) error {
+	return errNoNetlink
+}
+
+// DeleteTunnel is only supported on Linux.
+func DeleteTunnel(interfaceName string) error {
+	return errNoNetlink
+}
+
+// ConfigureTunnelPeer is only supported on Linux.
+func ConfigureTunnelPeer(interfaceName string, peer TunnelPeer) error {
+	return errNoNetlink
+}
+
+// RemoveTunnelPeer is only supported on Linux.
+func RemoveTunnelPeer(interfaceName, publicKey string) error {
+	return errNoNetlink
+}
+
+// TunnelPeers is only supported on Linux.
+func TunnelPeers(interfaceName string) ([]TunnelPeerStats, error) {
+	return nil, errNoNetlink
+}
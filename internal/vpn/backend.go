@@ -0,0 +1,187 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/network"
+)
+
+const (
+	// BackendNetlink manages the interface, peers, routes and rules in process.
+	BackendNetlink = "netlink"
+	// BackendWGQuick shells out to wg-quick and wg.
+	BackendWGQuick = "wg-quick"
+)
+
+// Backend brings the WireGuard interface up from its config file and
+// manages its peers.
+type Backend interface {
+	// Up creates the interface from /etc/wireguard/<iface>.conf, including
+	// its routes and policy rules, and runs the PreUp and PostUp hooks.
+	Up(interfaceName string) error
+	// Down runs the PreDown hooks, removes the interface with its routes and
+	// rules, and runs the PostDown hooks.
+	Down(interfaceName string) error
+	// Peers returns the peers of the running interface.
+	Peers(interfaceName string) ([]PeerStats, error)
+	// SetPeer adds or updates a peer, replacing its allowed IPs.
+	SetPeer(interfaceName string, peer network.TunnelPeer) error
+	// RemovePeer removes the peer with publicKey.
+	RemovePeer(interfaceName, publicKey string) error
+}
+
+// NewBackend returns the backend called name, defaulting to netlink.
+func NewBackend(name string) Backend {
+	if name == BackendWGQuick {
+		return wgQuickBackend{}
+	}
+	return netlinkBackend{}
+}
+
+// wgQuickBackend drives the interface with the wg-quick and wg tools.
+type wgQuickBackend struct{}
+
+func (wgQuickBackend) Up(interfaceName string) error {
+	return wgQuickUp(interfaceName)
+}
+
+func (wgQuickBackend) Down(interfaceName string) error {
+	return DisconnectVPN(interfaceName)
+}
+
+func (wgQuickBackend) Peers(interfaceName string) ([]PeerStats, error) {
+	return ReadPeerStats(interfaceName)
+}
+
+func (wgQuickBackend) SetPeer(interfaceName string, peer network.TunnelPeer) error {
+	args := []string{"peer", peer.PublicKey}
+	if peer.Endpoint != "" {
+		args = append(args, "endpoint", peer.Endpoint)
+	}
+	keepalive := "off"
+	if peer.PersistentKeepalive > 0 {
+		keepalive = strconv.Itoa(int(peer.PersistentKeepalive.Seconds()))
+	}
+	args = append(args, "persistent-keepalive", keepalive,
+		"allowed-ips", strings.Join(network.FormatPrefixes(peer.AllowedIPs), ","))
+	return wgSet(interfaceName, args...)
+}
+
+func (wgQuickBackend) RemovePeer(interfaceName, publicKey string) error {
+	return wgSet(interfaceName, "peer", publicKey, "remove")
+}
+
+// wgSet runs `wg set` on the interface.
+func wgSet(iface string, args ...string) error {
+	cmd := exec.Command("sudo", append([]string{"wg", "set", iface}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to configure WireGuard peer: %v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// netlinkBackend configures the interface through netlink and the WireGuard
+// generic netlink API, without wg-quick or the route command. It installs
+// the same table and rules as wg-quick.
+type netlinkBackend struct{}
+
+func (netlinkBackend) Up(interfaceName string) error {
+	tunnel, err := readTunnelConfig(interfaceName)
+	if err != nil {
+		return err
+	}
+	if err := runHooks(interfaceName, tunnel.PreUp); err != nil {
+		return err
+	}
+	if err := network.CreateTunnel(tunnel); err != nil {
+		return fmt.Errorf("failed to bring up WireGuard interface: %v", err)
+	}
+	if err := runHooks(interfaceName, tunnel.PostUp); err != nil {
+		if downErr := network.DeleteTunnel(interfaceName); downErr != nil {
+			err = errors.Join(err, downErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Down carries on without the hooks when the config file is gone, so that
+// an interface can always be removed.
+func (netlinkBackend) Down(interfaceName string) error {
+	tunnel, err := readTunnelConfig(interfaceName)
+	if err != nil {
+		tunnel = &network.TunnelConfig{}
+	}
+	if err := runHooks(interfaceName, tunnel.PreDown); err != nil {
+		return err
+	}
+	if err := network.DeleteTunnel(interfaceName); err != nil {
+		return fmt.Errorf("failed to disconnect VPN: %v", err)
+	}
+	return runHooks(interfaceName, tunnel.PostDown)
+}
+
+func (netlinkBackend) Peers(interfaceName string) ([]PeerStats, error) {
+	tunnelPeers, err := network.TunnelPeers(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty fields are reported as wg does.
+	peers := make([]PeerStats, 0, len(tunnelPeers))
+	for _, peer := range tunnelPeers {
+		stats := PeerStats{
+			PublicKey:       peer.PublicKey,
+			Endpoint:        peer.Endpoint,
+			AllowedIPs:      strings.Join(network.FormatPrefixes(peer.AllowedIPs), ","),
+			LatestHandshake: peer.LatestHandshake,
+			RxBytes:         peer.RxBytes,
+			TxBytes:         peer.TxBytes,
+		}
+		if stats.Endpoint == "" {
+			stats.Endpoint = "(none)"
+		}
+		if stats.AllowedIPs == "" {
+			stats.AllowedIPs = "(none)"
+		}
+		peers = append(peers, stats)
+	}
+	return peers, nil
+}
+
+func (netlinkBackend) SetPeer(interfaceName string, peer network.TunnelPeer) error {
+	return network.ConfigureTunnelPeer(interfaceName, peer)
+}
+
+func (netlinkBackend) RemovePeer(interfaceName, publicKey string) error {
+	return network.RemoveTunnelPeer(interfaceName, publicKey)
+}
+
+// readTunnelConfig parses the interface's WireGuard config file.
+func readTunnelConfig(interfaceName string) (*network.TunnelConfig, error) {
+	content, err := os.ReadFile(config.GetWireGuardConfigPath(interfaceName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	return network.ParseWireGuardConfig(interfaceName, string(content))
+}
+
+// runHooks runs config file hooks with a shell, replacing %i with the
+// interface name as wg-quick does.
+func runHooks(interfaceName string, hooks []string) error {
+	for _, hook := range hooks {
+		cmd := exec.Command("sh", "-c", strings.ReplaceAll(hook, "%i", interfaceName))
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("hook %q failed: %v\nOutput: %s", hook, err, string(output))
+		}
+	}
+	return nil
+}
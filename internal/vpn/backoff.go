@@ -0,0 +1,108 @@
+package vpn
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultFailureThreshold is how many consecutive failed checks trigger a reconnect.
+	DefaultFailureThreshold = 3
+	// DefaultBackoffInitial is the delay after the first failed reconnect.
+	DefaultBackoffInitial = 5 * time.Second
+	// DefaultBackoffMax caps the delay between reconnect attempts.
+	DefaultBackoffMax = 5 * time.Minute
+	// DefaultBackoffMultiplier grows the delay after each failed attempt.
+	DefaultBackoffMultiplier = 2.0
+	// DefaultBackoffJitter randomises each delay by up to this fraction.
+	DefaultBackoffJitter = 0.2
+	// DefaultStatusCheckInterval is how often the remote connection check runs.
+	DefaultStatusCheckInterval = 5 * time.Minute
+)
+
+// Clock abstracts time so the monitor loop can be driven by a fake in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Backoff computes exponentially growing, jittered delays between reconnect
+// attempts and enforces a retry budget.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is the fraction, from 0 to 1, by which a delay may deviate either way.
+	Jitter float64
+	// MaxRetries is the retry budget; zero means unlimited.
+	MaxRetries int
+	// Rand returns a value in [0, 1); nil uses math/rand.
+	Rand func() float64
+
+	attempt int
+}
+
+// NewBackoff creates a Backoff, replacing non-positive values with defaults.
+// A negative maxRetries is treated as unlimited.
+func NewBackoff(initial, max time.Duration, multiplier, jitter float64, maxRetries int) *Backoff {
+	if initial <= 0 {
+		initial = DefaultBackoffInitial
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+	if jitter < 0 || jitter > 1 {
+		jitter = DefaultBackoffJitter
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return &Backoff{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: multiplier,
+		Jitter:     jitter,
+		MaxRetries: maxRetries,
+	}
+}
+
+// Next returns the delay before the next attempt, or false once the retry
+// budget is spent.
+func (b *Backoff) Next() (time.Duration, bool) {
+	if b.MaxRetries > 0 && b.attempt >= b.MaxRetries {
+		return 0, false
+	}
+
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(b.attempt))
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	b.attempt++
+
+	random := rand.Float64
+	if b.Rand != nil {
+		random = b.Rand
+	}
+	delay *= 1 + b.Jitter*(2*random()-1)
+	return time.Duration(delay), true
+}
+
+// Attempts returns how many delays have been handed out since the last Reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset starts the next failure sequence from Initial with a full budget.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,120 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultFailoverCandidates is how many ranked relays are tried per scope.
+	DefaultFailoverCandidates = 3
+	// DefaultDenylistTTL is how long a failed relay is avoided.
+	DefaultDenylistTTL = 10 * time.Minute
+)
+
+// Denylist remembers recently failed relays for a limited time so that
+// failover does not pick them again straight away.
+type Denylist struct {
+	TTL time.Duration
+	Now func() time.Time
+
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// NewDenylist creates a Denylist, using the default TTL when ttl is not positive.
+func NewDenylist(ttl time.Duration) *Denylist {
+	if ttl <= 0 {
+		ttl = DefaultDenylistTTL
+	}
+	return &Denylist{TTL: ttl, Now: time.Now, until: make(map[string]time.Time)}
+}
+
+// Add denies hostname until the TTL expires.
+func (d *Denylist) Add(hostname string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until[hostname] = d.Now().Add(d.TTL)
+}
+
+// Hostnames returns the relays currently denied, dropping expired entries.
+func (d *Denylist) Hostnames() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.Now()
+	var hostnames []string
+	for hostname, until := range d.until {
+		if !now.Before(until) {
+			delete(d.until, hostname)
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// failover moves the tunnel off the current relay. The current relay is
+// denylisted, then the top FailoverCandidates of each scope allowed by the
+// failover policy are tried in ranked order until one connects.
+func (vm *VPNManager) failover(ctx context.Context) error {
+	criteria, err := vm.Config.Criteria()
+	if err != nil {
+		return fmt.Errorf("failed to build selection criteria: %v", err)
+	}
+
+	current := vm.Server()
+	if current != nil {
+		vm.Denylist.Add(current.Hostname)
+	}
+
+	scopes, err := criteria.FailoverScopes(current, vm.Config.FailoverPolicy)
+	if err != nil {
+		return err
+	}
+
+	count := vm.Config.FailoverCandidates
+	if count <= 0 {
+		count = DefaultFailoverCandidates
+	}
+
+	var errs []error
+	for _, scope := range scopes {
+		scope.Exclude = append(append([]string(nil), scope.Exclude...), vm.Denylist.Hostnames()...)
+		pipeline, err := scope.Pipeline(vm.Catalog)
+		if err != nil {
+			return err
+		}
+
+		candidates, err := pipeline.Select(ctx, count)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", scope.ScopeName(), err))
+			continue
+		}
+
+		for i := range candidates {
+			candidate := &candidates[i]
+			vm.Logger.Info("Failing over", zap.String("server", candidate.Hostname), zap.String("scope", scope.ScopeName()))
+			if _, err := vm.SwitchServer(candidate); err != nil {
+				vm.Denylist.Add(candidate.Hostname)
+				errs = append(errs, fmt.Errorf("%s: %v", candidate.Hostname, err))
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				continue
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no failover relay could be connected: %w", errors.Join(errs...))
+}
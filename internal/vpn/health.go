@@ -0,0 +1,195 @@
+package vpn
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthCheckInterval is how often the local tunnel health is sampled.
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultMaxHandshakeAge matches WireGuard's Reject-After-Time: a session
+	// older than this cannot carry traffic until a new handshake succeeds.
+	DefaultMaxHandshakeAge = 180 * time.Second
+	// DefaultStallTimeout is how long traffic may be sent without anything
+	// being received before the tunnel is considered stalled.
+	DefaultStallTimeout = 30 * time.Second
+)
+
+// PeerStats are the counters `wg show <iface> dump` reports for one peer.
+type PeerStats struct {
+	PublicKey string
+	Endpoint  string
+	// AllowedIPs is the comma-separated list routed to the peer, or "(none)".
+	AllowedIPs string
+	// LatestHandshake is zero when no handshake has completed yet.
+	LatestHandshake time.Time
+	RxBytes         uint64
+	TxBytes         uint64
+}
+
+// ReadPeerStats reads the peer counters of interfaceName.
+func ReadPeerStats(interfaceName string) ([]PeerStats, error) {
+	cmd := exec.Command("sudo", "wg", "show", interfaceName, "dump")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard stats: %v\nOutput: %s", err, string(output))
+	}
+	return ParseWGDump(string(output))
+}
+
+// ParseWGDump parses the output of `wg show <iface> dump`. The first line
+// describes the interface and is skipped; each following line is a peer:
+// public-key, preshared-key, endpoint, allowed-ips, latest-handshake,
+// transfer-rx, transfer-tx, persistent-keepalive.
+func ParseWGDump(output string) ([]PeerStats, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, fmt.Errorf("empty WireGuard dump")
+	}
+
+	var peers []PeerStats
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("malformed WireGuard dump line: %q", line)
+		}
+
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latest-handshake %q: %v", fields[4], err)
+		}
+		rx, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transfer-rx %q: %v", fields[5], err)
+		}
+		tx, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transfer-tx %q: %v", fields[6], err)
+		}
+
+		peer := PeerStats{
+			PublicKey:  fields[0],
+			Endpoint:   fields[2],
+			AllowedIPs: fields[3],
+			RxBytes:    rx,
+			TxBytes:    tx,
+		}
+		if handshake > 0 {
+			peer.LatestHandshake = time.Unix(handshake, 0)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// HealthReport is the outcome of one local health check.
+type HealthReport struct {
+	Healthy      bool
+	Reason       string
+	HandshakeAge time.Duration
+	RxBytes      uint64
+	TxBytes      uint64
+}
+
+// HealthChecker judges tunnel health from the interface's own counters, so
+// a dead relay is noticed within seconds and without leaving the host.
+//
+// An idle WireGuard tunnel does not handshake, so an old handshake alone is
+// not a failure. The tunnel is unhealthy when traffic is being sent while the
+// handshake is older than MaxHandshakeAge, or when transmitted bytes keep
+// growing without any received bytes for StallTimeout.
+type HealthChecker struct {
+	Interface       string
+	MaxHandshakeAge time.Duration
+	StallTimeout    time.Duration
+	// ReadStats and Now are replaceable for tests.
+	ReadStats func(interfaceName string) ([]PeerStats, error)
+	Now       func() time.Time
+
+	mu           sync.Mutex
+	sampled      bool
+	lastRx       uint64
+	lastTx       uint64
+	stalledSince time.Time
+}
+
+// NewHealthChecker creates a HealthChecker for interfaceName. Non-positive
+// durations select the defaults.
+func NewHealthChecker(interfaceName string, maxHandshakeAge, stallTimeout time.Duration) *HealthChecker {
+	if maxHandshakeAge <= 0 {
+		maxHandshakeAge = DefaultMaxHandshakeAge
+	}
+	if stallTimeout <= 0 {
+		stallTimeout = DefaultStallTimeout
+	}
+	return &HealthChecker{
+		Interface:       interfaceName,
+		MaxHandshakeAge: maxHandshakeAge,
+		StallTimeout:    stallTimeout,
+		ReadStats:       ReadPeerStats,
+		Now:             time.Now,
+	}
+}
+
+// Reset forgets previous samples, e.g. after the peer has been replaced.
+func (h *HealthChecker) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sampled = false
+	h.stalledSince = time.Time{}
+}
+
+// Check samples the interface and reports whether the tunnel is healthy.
+func (h *HealthChecker) Check() (HealthReport, error) {
+	peers, err := h.ReadStats(h.Interface)
+	if err != nil {
+		return HealthReport{}, err
+	}
+	if len(peers) == 0 {
+		return HealthReport{Reason: "interface has no peer"}, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer := peers[0]
+	now := h.Now()
+	report := HealthReport{Healthy: true, RxBytes: peer.RxBytes, TxBytes: peer.TxBytes}
+	if !peer.LatestHandshake.IsZero() {
+		report.HandshakeAge = now.Sub(peer.LatestHandshake)
+	}
+
+	// Counters going backwards mean the interface was recreated, which
+	// counts as neither sending nor stalled.
+	sending := h.sampled && peer.TxBytes > h.lastTx
+	receiving := h.sampled && peer.RxBytes > h.lastRx
+	h.sampled = true
+	h.lastRx = peer.RxBytes
+	h.lastTx = peer.TxBytes
+
+	switch {
+	case receiving || !sending:
+		h.stalledSince = time.Time{}
+	case h.stalledSince.IsZero():
+		h.stalledSince = now
+	}
+
+	switch {
+	case sending && !peer.LatestHandshake.IsZero() && report.HandshakeAge > h.MaxHandshakeAge:
+		report.Healthy = false
+		report.Reason = fmt.Sprintf("latest handshake is %s old", report.HandshakeAge.Round(time.Second))
+	case !h.stalledSince.IsZero() && now.Sub(h.stalledSince) >= h.StallTimeout:
+		report.Healthy = false
+		if peer.LatestHandshake.IsZero() {
+			report.Reason = fmt.Sprintf("no handshake and nothing received for %s", now.Sub(h.stalledSince).Round(time.Second))
+		} else {
+			report.Reason = fmt.Sprintf("nothing received for %s while sending", now.Sub(h.stalledSince).Round(time.Second))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,130 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultStatusAPIURL is Mullvad's connection check endpoint.
+	DefaultStatusAPIURL = "https://am.i.mullvad.net/json"
+	// DefaultStatusAPITimeout bounds a single connection check.
+	DefaultStatusAPITimeout = 10 * time.Second
+)
+
+// ConnectionStatus is the connection as seen from Mullvad's check endpoint.
+type ConnectionStatus struct {
+	IP           string  `json:"ip"`
+	Country      string  `json:"country"`
+	City         string  `json:"city"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Organization string  `json:"organization"`
+	// MullvadExitIP reports whether traffic leaves through a Mullvad relay.
+	MullvadExitIP bool `json:"mullvad_exit_ip"`
+	// ServerHostname is the relay traffic exits through, when MullvadExitIP is set.
+	ServerHostname string    `json:"mullvad_exit_ip_hostname"`
+	ServerType     string    `json:"mullvad_server_type"`
+	Blacklist      Blacklist `json:"blacklisted"`
+	// CountryCode is the ISO alpha-2 code derived from Country.
+	CountryCode string `json:"country_code"`
+	// CheckedAt is when the check completed.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Blacklist reports whether the exit IP appears on public blocklists.
+type Blacklist struct {
+	Blacklisted bool              `json:"blacklisted"`
+	Results     []BlacklistResult `json:"results"`
+}
+
+// BlacklistResult is the verdict of one blocklist.
+type BlacklistResult struct {
+	Name        string `json:"name"`
+	Link        string `json:"link"`
+	Blacklisted bool   `json:"blacklisted"`
+}
+
+// StatusHTTPError is returned when the check endpoint answers with a non-200 status.
+type StatusHTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusHTTPError) Error() string {
+	return fmt.Sprintf("status API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// StatusDecodeError is returned when the check endpoint's response is malformed.
+type StatusDecodeError struct {
+	Err error
+}
+
+func (e *StatusDecodeError) Error() string {
+	return fmt.Sprintf("failed to decode connection status: %v", e.Err)
+}
+
+func (e *StatusDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// StatusClient queries the connection check endpoint.
+type StatusClient struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewStatusClient creates a StatusClient. An empty endpoint selects Mullvad's
+// and a non-positive timeout selects DefaultStatusAPITimeout.
+func NewStatusClient(endpoint string, timeout time.Duration) *StatusClient {
+	if endpoint == "" {
+		endpoint = DefaultStatusAPIURL
+	}
+	if timeout <= 0 {
+		timeout = DefaultStatusAPITimeout
+	}
+	return &StatusClient{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Check fetches the current connection status.
+func (c *StatusClient) Check(ctx context.Context) (*ConnectionStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusHTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var status ConnectionStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, &StatusDecodeError{Err: err}
+	}
+	if status.IP == "" {
+		return nil, &StatusDecodeError{Err: fmt.Errorf("response has no ip field")}
+	}
+
+	status.CountryCode = validateCountry(status.Country)
+	status.CheckedAt = time.Now()
+	return &status, nil
+}
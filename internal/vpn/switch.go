@@ -0,0 +1,203 @@
+package vpn
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"GoGuard/internal/config"
+	"GoGuard/internal/detect"
+	"GoGuard/internal/network"
+	"go.uber.org/zap"
+)
+
+const (
+	// SwitchModePeer swaps the peer on the running interface, moving traffic only once the new relay has completed a handshake.
+	SwitchModePeer = "peer"
+	// SwitchModeRestart takes the interface down and brings it up again.
+	SwitchModeRestart = "restart"
+	// DefaultSwitchHandshakeTimeout bounds the wait for the new peer's handshake.
+	DefaultSwitchHandshakeTimeout = 5 * time.Second
+	// handshakePollInterval is how often the new peer is checked for a handshake.
+	handshakePollInterval = 100 * time.Millisecond
+)
+
+// SwitchResult reports how a server switch went.
+type SwitchResult struct {
+	From     string        `json:"from,omitempty"`
+	To       string        `json:"to"`
+	Mode     string        `json:"mode"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SwitchServer moves the tunnel to server. In peer mode the new relay is
+// brought up next to the current one and traffic only moves once it has
+// handshaked, so there is no window without a tunnel; if it never answers the
+// current relay is kept. Restart mode, also used when the interface is gone,
+// tears the interface down first.
+func (vm *VPNManager) SwitchServer(server *detect.MullvadServer) (*SwitchResult, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	start := time.Now()
+	result := &SwitchResult{To: server.Hostname, Mode: vm.Config.SwitchMode}
+	if vm.server != nil {
+		result.From = vm.server.Hostname
+	}
+
+	var err error
+	if result.Mode != SwitchModeRestart && InterfaceExists(vm.Config.InterfaceName) {
+		result.Mode = SwitchModePeer
+		err = vm.swapPeer(server)
+	} else {
+		result.Mode = SwitchModeRestart
+		err = vm.restart(server)
+	}
+	result.Duration = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+
+	vm.server = server
+	vm.connectedSince = time.Now()
+	vm.Logger.Info("Switched server",
+		zap.String("from", result.From),
+		zap.String("to", result.To),
+		zap.String("mode", result.Mode),
+		zap.Duration("duration", result.Duration))
+	return result, nil
+}
+
+// restart replaces the interface with one configured for server.
+func (vm *VPNManager) restart(server *detect.MullvadServer) error {
+	if err := vm.applyKillSwitch(relayEndpoint(server)); err != nil {
+		return fmt.Errorf("failed to update kill switch: %v", err)
+	}
+
+	// After a failed attempt the interface may already be gone.
+	if InterfaceExists(vm.Config.InterfaceName) {
+		if err := vm.Backend.Down(vm.Config.InterfaceName); err != nil {
+			return fmt.Errorf("failed to disconnect VPN: %v", err)
+		}
+	}
+
+	if err := vm.setupRelay(server); err != nil {
+		if disconnectErr := vm.Backend.Down(vm.Config.InterfaceName); disconnectErr != nil {
+			vm.Logger.Error("Failed to disconnect VPN after setup failure", zap.Error(disconnectErr))
+		}
+		return fmt.Errorf("failed to setup VPN: %v", err)
+	}
+	return nil
+}
+
+// setupRelay brings the interface up for server. With the kill switch on,
+// the Mullvad API used to generate a fresh config is unreachable while the
+// interface is down, so the existing config is pointed at server instead.
+func (vm *VPNManager) setupRelay(server *detect.MullvadServer) error {
+	if vm.Config.KillSwitch {
+		if err := config.UpdateWireGuardPeer(vm.Config.InterfaceName, server); err == nil {
+			return vm.Backend.Up(vm.Config.InterfaceName)
+		}
+	}
+	return SetupVPN(vm.Backend, vm.Config, server)
+}
+
+// swapPeer adds server as a second peer without any allowed IPs, waits for
+// its handshake, then moves the old peer's allowed IPs to it and removes
+// the old peer. Assigning allowed IPs to one peer takes them from any other,
+// so traffic moves over in one step.
+func (vm *VPNManager) swapPeer(server *detect.MullvadServer) error {
+	iface := vm.Config.InterfaceName
+	peers, err := vm.Backend.Peers(iface)
+	if err != nil {
+		return err
+	}
+
+	allowedIPs, err := vm.Config.AllowedIPs()
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if peer.PublicKey != server.PublicKey && peer.AllowedIPs != "" && peer.AllowedIPs != "(none)" {
+			if allowedIPs, err = network.ParsePrefixes(strings.Split(peer.AllowedIPs, ",")); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var current []string
+	for _, peer := range peers {
+		if peer.Endpoint != "(none)" {
+			current = append(current, peer.Endpoint)
+		}
+	}
+	endpoint := relayEndpoint(server)
+	if err := vm.applyKillSwitch(append(current, endpoint)...); err != nil {
+		return fmt.Errorf("failed to update kill switch: %v", err)
+	}
+
+	// A persistent keepalive makes the new peer handshake straight away.
+	newPeer := network.TunnelPeer{PublicKey: server.PublicKey, Endpoint: endpoint, PersistentKeepalive: time.Second}
+	if err := vm.Backend.SetPeer(iface, newPeer); err != nil {
+		return err
+	}
+
+	timeout := vm.Config.SwitchHandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultSwitchHandshakeTimeout
+	}
+	if err := waitForHandshake(vm.Backend, iface, server.PublicKey, timeout); err != nil {
+		if removeErr := vm.Backend.RemovePeer(iface, server.PublicKey); removeErr != nil {
+			vm.Logger.Error("Failed to remove unresponsive peer", zap.Error(removeErr))
+		}
+		if ksErr := vm.applyKillSwitch(current...); ksErr != nil {
+			vm.Logger.Error("Failed to restore kill switch", zap.Error(ksErr))
+		}
+		return err
+	}
+
+	newPeer.PersistentKeepalive = 0
+	newPeer.AllowedIPs = allowedIPs
+	if err := vm.Backend.SetPeer(iface, newPeer); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if peer.PublicKey == server.PublicKey {
+			continue
+		}
+		if err := vm.Backend.RemovePeer(iface, peer.PublicKey); err != nil {
+			vm.Logger.Error("Failed to remove old peer", zap.String("peer", peer.PublicKey), zap.Error(err))
+		}
+	}
+
+	if err := vm.applyKillSwitch(endpoint); err != nil {
+		vm.Logger.Error("Failed to narrow kill switch to the new relay", zap.Error(err))
+	}
+
+	if err := config.UpdateWireGuardPeer(iface, server); err != nil {
+		vm.Logger.Warn("Failed to update WireGuard config with the new peer", zap.Error(err))
+	}
+	return nil
+}
+
+// waitForHandshake polls the interface until the peer with publicKey has
+// completed a handshake.
+func waitForHandshake(backend Backend, iface, publicKey string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		peers, err := backend.Peers(iface)
+		if err != nil {
+			return err
+		}
+		for _, peer := range peers {
+			if peer.PublicKey == publicKey && !peer.LatestHandshake.IsZero() {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no handshake with the new peer within %s", timeout)
+		}
+		time.Sleep(handshakePollInterval)
+	}
+}
@@ -4,33 +4,363 @@ import (
 	"GoGuard/internal/config"
 	"GoGuard/internal/detect"
 	"GoGuard/internal/network"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/biter777/countries"
 	"go.uber.org/zap"
-	"io/ioutil"
-	"net/http"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const mullvadStatusAPI = "https://am.i.mullvad.net/json"
-
 type VPNManager struct {
-	Config *config.Config
-	Logger *zap.Logger
+	Config   *config.Config
+	Logger   *zap.Logger
+	Catalog  *detect.RelayCatalog
+	Status   *StatusClient
+	Health   *HealthChecker
+	Clock    Clock
+	Denylist *Denylist
+	Backend  Backend
+
+	mu             sync.Mutex
+	server         *detect.MullvadServer
+	originalDNS    string
+	routing        *network.RoutingSnapshot
+	connected      bool
+	connectedSince time.Time
+	monitorCancel  context.CancelFunc
+	monitorDone    chan struct{}
 }
 
-func NewVPNManager(config *config.Config, logger *zap.Logger) *VPNManager {
+func NewVPNManager(config *config.Config, logger *zap.Logger, catalog *detect.RelayCatalog) *VPNManager {
+	backend := NewBackend(config.Backend)
+	health := NewHealthChecker(config.InterfaceName, config.MaxHandshakeAge, config.StallTimeout)
+	health.ReadStats = backend.Peers
 	return &VPNManager{
-		Config: config,
-		Logger: logger,
+		Config:   config,
+		Logger:   logger,
+		Catalog:  catalog,
+		Status:   NewStatusClient(config.StatusAPIURL, config.StatusAPITimeout),
+		Health:   health,
+		Clock:    realClock{},
+		Denylist: NewDenylist(config.FailoverDenylistTTL),
+		Backend:  backend,
 	}
 }
-func SetupVPN(cfg *config.Config, server *detect.MullvadServer) error {
+
+// Connect brings the tunnel up to server and points routing and DNS at it,
+// remembering the original DNS configuration and routing state for
+// Disconnect. Anything set up before a failure is torn down again.
+func (vm *VPNManager) Connect(server *detect.MullvadServer) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if vm.connected {
+		return fmt.Errorf("already connected to %s", vm.server.Hostname)
+	}
+
+	originalDNS, err := network.SaveOriginalDNSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to save original DNS config: %v", err)
+	}
+	if err := network.BackupDNSConfig(originalDNS); err != nil {
+		vm.Logger.Warn("Failed to back up DNS config; 'goguard down' will not restore it", zap.Error(err))
+	}
+
+	routing, err := network.SnapshotRouting(vm.Config.InterfaceName)
+	if err != nil {
+		vm.Logger.Warn("Failed to snapshot routing; only the tunnel's own routes and rules will be removed on disconnect", zap.Error(err))
+	} else if err := network.SaveRoutingSnapshot(routing); err != nil {
+		vm.Logger.Warn("Failed to save routing snapshot; 'goguard down' will not restore it", zap.Error(err))
+	}
+
+	if err := SetupVPN(vm.Backend, vm.Config, server); err != nil {
+		vm.teardown(originalDNS, routing)
+		return fmt.Errorf("failed to setup VPN: %v", err)
+	}
+
+	if err := network.SetupDNS(vm.Config.DNS); err != nil {
+		vm.teardown(originalDNS, routing)
+		return fmt.Errorf("failed to setup DNS: %v", err)
+	}
+
+	if err := network.AddBypassRules(vm.Config.LocalNetworkCIDRs); err != nil {
+		vm.teardown(originalDNS, routing)
+		return fmt.Errorf("failed to route local networks around the tunnel: %v", err)
+	}
+
+	if err := vm.applyAppBypass(); err != nil {
+		vm.teardown(originalDNS, routing)
+		return fmt.Errorf("failed to route bypassed applications around the tunnel: %v", err)
+	}
+
+	if err := vm.applyKillSwitch(relayEndpoint(server)); err != nil {
+		vm.teardown(originalDNS, routing)
+		return fmt.Errorf("failed to enable kill switch: %v", err)
+	}
+
+	vm.server = server
+	vm.originalDNS = originalDNS
+	vm.routing = routing
+	vm.connected = true
+	vm.connectedSince = time.Now()
+	return nil
+}
+
+// Disconnect tears the tunnel down and restores routing and DNS.
+func (vm *VPNManager) Disconnect() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if !vm.connected {
+		return nil
+	}
+
+	err := Teardown(vm.Backend, vm.Config.InterfaceName, vm.originalDNS, vm.routing)
+	vm.connected = false
+	vm.server = nil
+	vm.routing = nil
+	return err
+}
+
+// Start begins monitoring the established connection in the background. The
+// monitor runs until Stop; ctx only bounds startup.
+func (vm *VPNManager) Start(ctx context.Context) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if !vm.connected {
+		return fmt.Errorf("not connected")
+	}
+	if vm.monitorDone != nil {
+		return nil
+	}
+
+	monitorCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	vm.monitorCancel = cancel
+	vm.monitorDone = done
+	go func() {
+		defer close(done)
+		vm.MonitorConnection(monitorCtx)
+	}()
+	return nil
+}
+
+// Stop stops the monitor, waiting for it until ctx is done, and tears the
+// connection down. Only the first call after a Connect tears anything down.
+func (vm *VPNManager) Stop(ctx context.Context) error {
+	vm.mu.Lock()
+	cancel, done := vm.monitorCancel, vm.monitorDone
+	vm.monitorCancel = nil
+	vm.monitorDone = nil
+	vm.mu.Unlock()
+
+	var errs []error
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("monitor did not stop: %w", ctx.Err()))
+		}
+	}
+	if err := vm.Disconnect(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Recover cleans up after a session that ended without disconnecting, such
+// as after a crash. It must run before relay selection, which would otherwise
+// fetch and probe relays through the routing and firewall state left behind.
+// With a saved routing snapshot the old tunnel is torn down and the DNS
+// configuration and routing state are restored. Without one, GoGuard's rules
+// and nftables tables are removed when the interface is gone, as no tunnel
+// can be using them.
+func Recover(cfg *config.Config, logger *zap.Logger) error {
+	routing, err := SavedRouting()
+	if err != nil {
+		return err
+	}
+	if routing == nil {
+		if InterfaceExists(cfg.InterfaceName) {
+			return nil
+		}
+		err := errors.Join(network.RemoveBypassRules(), network.RemoveAppBypass(), network.RemoveKillSwitch())
+		if err != nil {
+			return fmt.Errorf("failed to remove stale rules: %v", err)
+		}
+		return nil
+	}
+	if routing.OwnerRunning() {
+		return fmt.Errorf("goguard process %d is still connected; run 'goguard down' first", routing.PID)
+	}
+
+	originalDNS, err := network.LoadDNSBackup()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	logger.Warn("Previous session did not disconnect, restoring its saved state",
+		zap.Int("pid", routing.PID), zap.Time("snapshot", routing.TakenAt))
+	if err := Teardown(NewBackend(cfg.Backend), cfg.InterfaceName, originalDNS, routing); err != nil {
+		return fmt.Errorf("failed to clean up after the previous session: %v", err)
+	}
+	return nil
+}
+
+// SavedRouting returns the routing snapshot saved by Connect, or nil when
+// there is none. A snapshot from before the last boot is discarded.
+func SavedRouting() (*network.RoutingSnapshot, error) {
+	routing, err := network.LoadRoutingSnapshot()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !routing.FromCurrentBoot() {
+		return nil, network.RemoveRoutingSnapshot()
+	}
+	return routing, nil
+}
+
+// teardown logs rather than returns failures, for rolling back a failed Connect.
+func (vm *VPNManager) teardown(originalDNS string, routing *network.RoutingSnapshot) {
+	if err := Teardown(vm.Backend, vm.Config.InterfaceName, originalDNS, routing); err != nil {
+		vm.Logger.Error("Failed to tear down after connect failure", zap.Error(err))
+	}
+}
+
+// Connected reports whether the manager has a tunnel up.
+func (vm *VPNManager) Connected() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.connected
+}
+
+// Server returns the relay the tunnel is connected to, or nil.
+func (vm *VPNManager) Server() *detect.MullvadServer {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.server
+}
+
+// ConnectedSince returns when the current connection was established.
+func (vm *VPNManager) ConnectedSince() time.Time {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.connectedSince
+}
+
+// OriginalDNS returns the DNS configuration saved by Connect.
+func (vm *VPNManager) OriginalDNS() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.originalDNS
+}
+
+// Teardown takes the interface down with backend, restores originalDNS when
+// it is set, removes the LAN and application bypass rules and the kill switch,
+// and finally puts routes and rules back to routing when it is set, removing
+// the saved snapshot once that succeeded. It carries on past failures and
+// returns them all. An interface that is already gone is skipped.
+func Teardown(backend Backend, interfaceName, originalDNS string, routing *network.RoutingSnapshot) error {
+	var errs []error
+	if InterfaceExists(interfaceName) {
+		if err := backend.Down(interfaceName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if originalDNS != "" {
+		if err := network.RevertDNSConfig(originalDNS); err != nil {
+			errs = append(errs, err)
+		} else if err := network.RemoveDNSBackup(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := network.RemoveBypassRules(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := network.RemoveAppBypass(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := network.RemoveKillSwitch(); err != nil {
+		errs = append(errs, err)
+	}
+	if routing != nil {
+		if err := routing.Restore(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore routing: %v", err))
+		} else if err := network.RemoveRoutingSnapshot(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyKillSwitch limits traffic outside the tunnel to endpoints when the
+// kill switch is enabled.
+func (vm *VPNManager) applyKillSwitch(endpoints ...string) error {
+	if !vm.Config.KillSwitch {
+		return nil
+	}
+	bypass, err := vm.Config.BypassPrefixes()
+	if err != nil {
+		return err
+	}
+	killSwitch := &network.KillSwitch{
+		Interface:       vm.Config.InterfaceName,
+		Endpoints:       endpoints,
+		LocalNetworks:   bypass,
+		AllowBypassMark: len(vm.Config.AppBypassCgroups()) > 0,
+	}
+	return killSwitch.Apply()
+}
+
+// applyAppBypass marks the traffic of the bypass cgroups so that it is routed
+// around the tunnel. The exec cgroup is created up front because nftables
+// only matches cgroups that exist when the rules are loaded.
+func (vm *VPNManager) applyAppBypass() error {
+	cgroups := vm.Config.AppBypassCgroups()
+	if len(cgroups) == 0 {
+		return nil
+	}
+	if vm.Config.BypassExecCgroup != "" {
+		if _, err := network.CreateCgroup(vm.Config.BypassExecCgroup); err != nil {
+			return err
+		}
+	}
+
+	appBypass := &network.AppBypass{
+		Interface: vm.Config.InterfaceName,
+		Cgroups:   cgroups,
+		DNS:       vm.Config.DNS,
+	}
+	missing, err := appBypass.Apply()
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		vm.Logger.Warn("Bypass cgroups do not exist and were skipped", zap.Strings("cgroups", missing))
+	}
+	return nil
+}
+
+// relayEndpoint returns the WireGuard endpoint of server as "ip:port".
+func relayEndpoint(server *detect.MullvadServer) string {
+	return net.JoinHostPort(server.IPv4AddrIn, strconv.Itoa(detect.DefaultWireGuardPort))
+}
+
+// SetupVPN writes the WireGuard config for server and brings the interface
+// up from it with backend.
+func SetupVPN(backend Backend, cfg *config.Config, server *detect.MullvadServer) error {
 	wireGuardConfig, err := config.GenerateWireGuardConfig(cfg, server)
 	if err != nil {
 		return fmt.Errorf("failed to generate WireGuard config: %v", err)
@@ -50,63 +380,132 @@ func SetupVPN(cfg *config.Config, server *detect.MullvadServer) error {
 		return fmt.Errorf("failed to write WireGuard config: %v", err)
 	}
 
-	cmd := exec.Command("sudo", "wg-quick", "up", cfg.InterfaceName)
+	return backend.Up(cfg.InterfaceName)
+}
+
+// wgQuickUp brings the interface up from its WireGuard config file.
+func wgQuickUp(interfaceName string) error {
+	cmd := exec.Command("sudo", "wg-quick", "up", interfaceName)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to bring up WireGuard interface: %v\nOutput: %s", err, string(output))
 	}
-
 	return nil
 }
-func (vm *VPNManager) MonitorConnection(originalDNS string) {
-	defer func() {
-		if err := network.RevertDefaultRoute(); err != nil {
-			vm.Logger.Error("Failed to revert default route", zap.Error(err))
-		}
 
-		if err := network.RevertDNSConfig(originalDNS); err != nil {
-			vm.Logger.Error("Failed to revert DNS config", zap.Error(err))
-		}
-	}()
+// MonitorConnection watches the tunnel until ctx is cancelled and fails over
+// to another relay once FailureThreshold consecutive checks fail. Failed
+// reconnects are retried with exponential backoff until the retry budget is
+// spent, at which point the connection is torn down.
+func (vm *VPNManager) MonitorConnection(ctx context.Context) {
+	interval := vm.Config.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	threshold := vm.Config.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	backoff := NewBackoff(vm.Config.BackoffInitial, vm.Config.BackoffMax, vm.Config.BackoffMultiplier, vm.Config.BackoffJitter, vm.Config.MaxRetries)
 
+	var lastStatusCheck time.Time
+	failures := 0
 	for {
-		secure, _, _, _, _, _, _, err := VPNStatus()
-		if err != nil || !secure {
-			vm.Logger.Info("Connection is not secure or error occurred, switching servers...")
-
-			selectedServer, err := detect.SelectBestServer(vm.Config.ServerName, vm.Config.CountryCode, vm.Config.UseLatencyBasedSelection)
-			if err != nil {
-				vm.Logger.Error("Failed to select server", zap.Error(err))
-				continue
+		if vm.checkHealth(ctx, &lastStatusCheck) {
+			failures = 0
+			backoff.Reset()
+			if !vm.wait(ctx, interval) {
+				return
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		failures++
+		if failures < threshold {
+			vm.Logger.Info("Connection check failed", zap.Int("failures", failures), zap.Int("threshold", threshold))
+			if !vm.wait(ctx, interval) {
+				return
 			}
+			continue
+		}
 
-			if err := vm.SwitchServer(selectedServer); err != nil {
-				vm.Logger.Error("Failed to switch servers", zap.Error(err))
-				if disconnectErr := DisconnectVPN(vm.Config.InterfaceName); disconnectErr != nil {
+		vm.Logger.Info("Connection is not secure or error occurred, switching servers...")
+		if err := vm.failover(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay, ok := backoff.Next()
+			if !ok && vm.Config.KillSwitch {
+				vm.Logger.Error("Reconnect retry budget exhausted; the kill switch keeps blocking traffic until disconnect", zap.Int("attempts", backoff.Attempts()), zap.Error(err))
+				return
+			}
+			if !ok {
+				vm.Logger.Error("Reconnect retry budget exhausted, disconnecting", zap.Int("attempts", backoff.Attempts()), zap.Error(err))
+				if disconnectErr := vm.Disconnect(); disconnectErr != nil {
 					vm.Logger.Error("Failed to disconnect VPN after switch failure", zap.Error(disconnectErr))
 				}
-				break
+				return
+			}
+			vm.Logger.Error("Failed to reconnect", zap.Error(err), zap.Duration("retry_in", delay))
+			if !vm.wait(ctx, delay) {
+				return
 			}
+			continue
+		}
+
+		failures = 0
+		backoff.Reset()
+		vm.Health.Reset()
+		if !vm.wait(ctx, interval) {
+			return
 		}
-		time.Sleep(5 * time.Minute)
 	}
 }
 
-func (vm *VPNManager) SwitchServer(server *detect.MullvadServer) error {
-	err := DisconnectVPN(vm.Config.InterfaceName)
-	if err != nil {
-		return fmt.Errorf("failed to disconnect VPN: %v", err)
+// wait sleeps for d on the manager's clock, returning false if ctx is
+// cancelled first.
+func (vm *VPNManager) wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-vm.Clock.After(d):
+		return true
 	}
+}
 
-	err = SetupVPN(vm.Config, server)
+// checkHealth runs the local health check and, every StatusCheckInterval, the
+// remote status check. The remote check goes through the tunnel itself, so it
+// is only consulted while the local counters look fine.
+func (vm *VPNManager) checkHealth(ctx context.Context, lastStatusCheck *time.Time) bool {
+	report, err := vm.Health.Check()
 	if err != nil {
-		if disconnectErr := DisconnectVPN(vm.Config.InterfaceName); disconnectErr != nil {
-			vm.Logger.Error("Failed to disconnect VPN after setup failure", zap.Error(disconnectErr))
-		}
-		return fmt.Errorf("failed to setup VPN: %v", err)
+		vm.Logger.Warn("Failed to read tunnel health", zap.Error(err))
+		return false
+	}
+	if !report.Healthy {
+		vm.Logger.Warn("Tunnel is unhealthy", zap.String("reason", report.Reason))
+		return false
 	}
 
-	return nil
+	statusInterval := vm.Config.StatusCheckInterval
+	if statusInterval <= 0 {
+		statusInterval = DefaultStatusCheckInterval
+	}
+	now := vm.Clock.Now()
+	if now.Sub(*lastStatusCheck) < statusInterval {
+		return true
+	}
+	*lastStatusCheck = now
+
+	status, err := vm.Status.Check(ctx)
+	if err != nil {
+		vm.Logger.Warn("Failed to check connection status", zap.Error(err))
+		return false
+	}
+	return status.MullvadExitIP
 }
 
 func DisconnectVPN(interfaceName string) error {
@@ -118,32 +517,10 @@ func DisconnectVPN(interfaceName string) error {
 	return nil
 }
 
-func VPNStatus() (bool, string, string, string, bool, string, bool, error) {
-	resp, err := http.Get(mullvadStatusAPI)
-	if err != nil {
-		return false, "", "", "", false, "", false, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, "", "", "", false, "", false, err
-	}
-
-	var result map[string]interface{}
-	json.Unmarshal(body, &result)
-
-	secure, _ := result["mullvad_exit_ip"].(bool)
-	ip, _ := result["ip"].(string)
-	country, _ := result["country"].(string)
-	city, _ := result["city"].(string)
-	mullvadServer, _ := result["mullvad_server"].(bool)
-	organization, _ := result["organization"].(string)
-	blacklisted, _ := result["blacklisted"].(bool)
-
-	countryCode := validateCountry(country)
-
-	return secure, ip, countryCode, city, mullvadServer, organization, blacklisted, nil
+// InterfaceExists reports whether the WireGuard interface is present.
+func InterfaceExists(interfaceName string) bool {
+	_, err := net.InterfaceByName(interfaceName)
+	return err == nil
 }
 
 func validateCountry(country string) string {